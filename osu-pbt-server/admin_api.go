@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// adminAPICommands are the stdin commands the admin api runs.
+var adminAPICommands = []string{"online", "toirc", "tosync", "kick", "ban", "unban"}
+
+const adminAPIMaxBody = 64 * 1024
+
+var ansiEscapeRegex = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// AdminRequest runs a command, args are by the names of the usage, e.g.
+//
+//	{"command": "ban", "args": {"username": "peppy", "time": "1d"}}
+type AdminRequest struct {
+	Command string                 `json:"command"`
+	Args    map[string]interface{} `json:"args"`
+}
+
+type AdminResponse struct {
+	OK     bool        `json:"ok"`
+	Output []string    `json:"output"`         // what the command printed, line by line
+	Data   interface{} `json:"data,omitempty"` // the result of the command, see the Admin*Result types
+	Error  string      `json:"error,omitempty"`
+	Usage  string      `json:"usage,omitempty"`
+}
+
+// adminOutput collects what a command printed and the result it reported.
+type adminOutput struct {
+	bytes.Buffer
+	result  interface{}
+	failure string
+}
+
+func (o *adminOutput) SetResult(v interface{}) {
+	o.result = v
+}
+
+func (o *adminOutput) Fail(message string) {
+	o.failure = message
+}
+
+type AdminArg struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Optional bool   `json:"optional"`
+}
+
+type AdminCommand struct {
+	Command string     `json:"command"`
+	Usage   string     `json:"usage"`
+	Detail  string     `json:"detail"`
+	Args    []AdminArg `json:"args"`
+}
+
+// AdminKickResult is the result of kick, the ids of the connections taken offline.
+type AdminKickResult struct {
+	Username    string  `json:"username"`
+	Connections []int64 `json:"connections"`
+}
+
+// AdminBanResult is the result of ban and unban, Until is RFC 3339.
+type AdminBanResult struct {
+	Username string `json:"username"`
+	UID      int64  `json:"uid"`
+	Banned   bool   `json:"banned"`
+	Until    string `json:"until,omitempty"`
+}
+
+// AdminDeliveryResult is the result of toirc, the IRC messages queued,
+// and tosync, the connections notified.
+type AdminDeliveryResult struct {
+	Username  string `json:"username"`
+	Delivered int    `json:"delivered"`
+}
+
+type AdminOnlineUser struct {
+	Username    string            `json:"username"`
+	Connections []AdminConnection `json:"connections"`
+}
+
+type AdminConnection struct {
+	ID        int64  `json:"id"`
+	Version   string `json:"version"`
+	Overflows int64  `json:"overflows"`
+	Dropped   int64  `json:"dropped"`
+}
+
+func adminOnlineData() interface{} {
+	users := []AdminOnlineUser{}
+	for _, name := range userBukkit.Usernames() {
+		user := AdminOnlineUser{Username: name, Connections: []AdminConnection{}}
+		for _, c := range userBukkit.GetClients(name) {
+			overflows, dropped := c.sendQueue.Overflows()
+			user.Connections = append(user.Connections, AdminConnection{
+				ID:        c.id,
+				Version:   c.version.String(),
+				Overflows: overflows,
+				Dropped:   dropped,
+			})
+		}
+		users = append(users, user)
+	}
+	return users
+}
+
+// adminAuthorized checks the "Authorization: Bearer <adminSecret>" header.
+func adminAuthorized(req *http.Request) bool {
+	const scheme = "Bearer "
+	auth := req.Header.Get("Authorization")
+	if len(auth) <= len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) {
+		return false
+	}
+	secret := auth[len(scheme):]
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(config.AdminSecret)) == 1
+}
+
+// adminArgString converts a json value of an argument, numbers are allowed for int arguments.
+func adminArgString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// adminOutputLines splits the output of a command into lines without the terminal colors.
+func adminOutputLines(output string) []string {
+	lines := []string{}
+	output = ansiEscapeRegex.ReplaceAllString(output, "")
+	for _, line := range strings.FieldsFunc(output, func(r rune) bool { return r == '\n' || r == '\r' }) {
+		if line = strings.TrimRight(line, " \t"); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func writeAdminJSON(rw http.ResponseWriter, status int, v interface{}) {
+	json, _ := json.Marshal(v)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(json)
+}
+
+// initAdminAPI serves the admin commands of cm on /admin/api,
+// GET lists the commands and POST runs one. It's disabled without an adminSecret.
+func initAdminAPI(cm *CommandManager) {
+	if len(config.AdminSecret) == 0 {
+		return
+	}
+
+	commands := make(map[string]*RegisterCommand)
+	for _, name := range adminAPICommands {
+		rcmd, ok := cm.Find(name)
+		if !ok {
+			panic(fmt.Sprintf("admin api: command %s isn't registered", name))
+		}
+		commands[name] = rcmd
+	}
+
+	http.HandleFunc("/admin/api", func(rw http.ResponseWriter, req *http.Request) {
+		if !adminAuthorized(req) {
+			log.Warningf("[Admin API] Unauthorized request from %s", req.RemoteAddr)
+			writeAdminJSON(rw, http.StatusUnauthorized, AdminResponse{Output: []string{}, Error: "unauthorized"})
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			list := []AdminCommand{}
+			for _, name := range adminAPICommands {
+				rcmd := commands[name]
+				cmd := AdminCommand{Command: name, Usage: rcmd.Usage(), Detail: rcmd.detail, Args: []AdminArg{}}
+				for _, spec := range rcmd.specs {
+					cmd.Args = append(cmd.Args, AdminArg{Name: spec.Name, Type: spec.Type, Optional: spec.Optional})
+				}
+				list = append(list, cmd)
+			}
+			writeAdminJSON(rw, http.StatusOK, struct {
+				Commands []AdminCommand `json:"commands"`
+			}{list})
+			return
+		case http.MethodPost:
+		default:
+			rw.Header().Set("Allow", "GET, POST")
+			writeAdminJSON(rw, http.StatusMethodNotAllowed, AdminResponse{Output: []string{}, Error: "method not allowed"})
+			return
+		}
+
+		var adminReq AdminRequest
+		if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, adminAPIMaxBody)).Decode(&adminReq); err != nil {
+			writeAdminJSON(rw, http.StatusBadRequest, AdminResponse{Output: []string{}, Error: "malformed request: " + err.Error()})
+			return
+		}
+
+		rcmd, ok := commands[adminReq.Command]
+		if !ok {
+			writeAdminJSON(rw, http.StatusNotFound, AdminResponse{Output: []string{}, Error: fmt.Sprintf("unknown command %q", adminReq.Command)})
+			return
+		}
+
+		named := make(map[string]string)
+		for name, value := range adminReq.Args {
+			s, ok := adminArgString(value)
+			if !ok {
+				writeAdminJSON(rw, http.StatusBadRequest, AdminResponse{Output: []string{}, Error: fmt.Sprintf("%s must be a string or a number", name), Usage: rcmd.Usage()})
+				return
+			}
+			named[name] = s
+		}
+
+		log.Infof("[Admin API] %s runs %s", req.RemoteAddr, adminReq.Command)
+		var output adminOutput
+		if err := cm.RunNamed("Admin API", rcmd, named, &output); err != nil {
+			writeAdminJSON(rw, http.StatusBadRequest, AdminResponse{Output: adminOutputLines(output.String()), Error: err.Message, Usage: err.Usage})
+			return
+		}
+
+		//the command ran but failed, e.g. the user is offline
+		if len(output.failure) > 0 {
+			writeAdminJSON(rw, http.StatusUnprocessableEntity, AdminResponse{Output: adminOutputLines(output.String()), Error: ansiEscapeRegex.ReplaceAllString(output.failure, "")})
+			return
+		}
+		writeAdminJSON(rw, http.StatusOK, AdminResponse{OK: true, Output: adminOutputLines(output.String()), Data: output.result})
+	})
+}
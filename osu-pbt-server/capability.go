@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+
+	mapset "github.com/deckarep/golang-set"
+	"github.com/hashicorp/go-version"
+)
+
+// Capabilities of the server a plugin can negotiate.
+const (
+	CAP_TOKEN       = "token"       // !assign_token sends a token to Sync
+	CAP_REQUEST_ID  = "request-id"  // binary frames carry a request id
+	CAP_PP_UPDATE   = "pp-update"   // pp changes are pushed after RTPPD messages
+	CAP_PRESENCE    = "presence"    // in-game presence is pushed as RPL_PRESENCE
+	CAP_NOW_PLAYING = "now-playing" // /np is pushed as RPL_NOW_PLAYING
+)
+
+type capability struct {
+	name   string
+	since  *version.Version // plugins from this version on get the capability without a ack
+	v2Only bool             // pushed as envelopes, the binary protocol has no frame for it
+}
+
+var capabilities = []capability{
+	{CAP_TOKEN, version.Must(version.NewVersion("1.3.0")), false},
+	{CAP_REQUEST_ID, version.Must(version.NewVersion("1.4.0")), false},
+	{CAP_PP_UPDATE, PROTOCOL_V2_VERSION, true},
+	{CAP_PRESENCE, PROTOCOL_V2_VERSION, false},
+	{CAP_NOW_PLAYING, PROTOCOL_V2_VERSION, false},
+}
+
+// CapabilitiesData is pushed to every client after connecting, and answers a capability ack.
+type CapabilitiesData struct {
+	Protocol       int32    `json:"protocol"`
+	RateLimit      int32    `json:"rateLimit"`      // messages per minute
+	MaxMessageSize int32    `json:"maxMessageSize"` // bytes
+	Opcodes        []uint16 `json:"opcodes"`
+	Capabilities   []string `json:"capabilities"`
+}
+
+type capabilitiesArgs struct {
+	Capabilities []string `json:"capabilities"`
+}
+
+// defaultCapabilities returns the capabilities implied by a plugin version.
+func defaultCapabilities(ver *version.Version) mapset.Set {
+	set := mapset.NewSet()
+	for _, capability := range capabilities {
+		if !ver.LessThan(capability.since) {
+			set.Add(capability.name)
+		}
+	}
+	return set
+}
+
+// supports reports whether the protocol of the client can carry a capability.
+func (c *Client) supports(capability capability) bool {
+	return !capability.v2Only || c.protocol == PROTOCOL_V2
+}
+
+// Can reports whether the client negotiated a capability.
+func (c *Client) Can(name string) bool {
+	return c.capabilities.Contains(name)
+}
+
+func (c *Client) capabilitiesData(set mapset.Set) CapabilitiesData {
+	names := []string{}
+	for _, capability := range capabilities {
+		if set.Contains(capability.name) {
+			names = append(names, capability.name)
+		}
+	}
+
+	return CapabilitiesData{
+		Protocol:       int32(c.protocol),
+		RateLimit:      config.MaxMessageCountPerMinute,
+		MaxMessageSize: maxMessageSize,
+		Opcodes:        wsCommandManager.Opcodes(),
+		Capabilities:   names,
+	}
+}
+
+// SendCapabilitiesToWS offers the capabilities the protocol of the client can carry.
+func (c *Client) SendCapabilitiesToWS() {
+	all := mapset.NewSet()
+	for _, capability := range capabilities {
+		if c.supports(capability) {
+			all.Add(capability.name)
+		}
+	}
+	data := c.capabilitiesData(all)
+
+	if c.protocol == PROTOCOL_V2 {
+		c.sendEnvelope(ENVELOPE_CAPABILITIES, 0, data)
+		return
+	}
+	c.SendBinaryToWS(c.encodeFrame(RPL_CAPABILITIES, 0, data))
+}
+
+// ackCapabilities keeps the acknowledged subset of the server capabilities.
+func (c *Client) ackCapabilities(req *WSRequest) {
+	var names []string
+	var ok bool
+	if c.protocol == PROTOCOL_V2 {
+		var args capabilitiesArgs
+		ok = json.Unmarshal(req.Payload, &args) == nil
+		names = args.Capabilities
+	} else {
+		names, ok = readBinaryStrings(req.Payload)
+	}
+
+	if !ok {
+		c.ReplyError(req, ERROR_BAD_ENVELOPE, "The capability list can't be decoded.")
+		return
+	}
+
+	c.capabilities.Clear()
+	for _, name := range names {
+		for _, capability := range capabilities {
+			if capability.name == name && c.supports(capability) {
+				c.capabilities.Add(name)
+			}
+		}
+	}
+
+	c.Reply(req, RPL_CAPABILITIES, c.capabilitiesData(c.capabilities))
+}
+
+// readBinaryStrings decodes int32 count | count * (int32 length | utf-8 bytes).
+func readBinaryStrings(payload []byte) ([]string, bool) {
+	r := bytes.NewReader(payload)
+
+	var count int32
+	if binary.Read(r, binary.LittleEndian, &count) != nil || count < 0 {
+		return nil, false
+	}
+
+	strs := []string{}
+	for i := int32(0); i < count; i++ {
+		var length int32
+		if binary.Read(r, binary.LittleEndian, &length) != nil || length < 0 || int(length) > r.Len() {
+			return nil, false
+		}
+		str := make([]byte, length)
+		r.Read(str)
+		strs = append(strs, string(str))
+	}
+	return strs, true
+}
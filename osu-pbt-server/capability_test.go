@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// binaryStrings encodes int32 count | count * (int32 length | bytes), lengths can be faked.
+func binaryStrings(count int32, strs []string, lengths ...int32) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, count)
+	for i, str := range strs {
+		length := int32(len(str))
+		if i < len(lengths) {
+			length = lengths[i]
+		}
+		binary.Write(&buf, binary.LittleEndian, length)
+		buf.WriteString(str)
+	}
+	return buf.Bytes()
+}
+
+func TestReadBinaryStrings(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		strs    []string
+		ok      bool
+	}{
+		{"empty list", binaryStrings(0, nil), []string{}, true},
+		{"strings", binaryStrings(2, []string{"token", "pp-update"}), []string{"token", "pp-update"}, true},
+		{"empty string", binaryStrings(1, []string{""}), []string{""}, true},
+		{"utf-8", binaryStrings(1, []string{"日本"}), []string{"日本"}, true},
+		{"no payload", nil, nil, false},
+		{"short count", []byte{1, 0}, nil, false},
+		{"negative count", binaryStrings(-1, nil), nil, false},
+		{"count too big", binaryStrings(2, []string{"token"}), nil, false},
+		{"negative length", binaryStrings(1, []string{"token"}, -1), nil, false},
+		{"length too big", binaryStrings(1, []string{"token"}, 6), nil, false},
+		{"huge length", binaryStrings(1, []string{"token"}, 1<<30), nil, false},
+	}
+
+	for _, test := range tests {
+		strs, ok := readBinaryStrings(test.payload)
+		if ok != test.ok {
+			t.Errorf("%s: ok = %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(strs, test.strs) {
+			t.Errorf("%s: = %q, want %q", test.name, strs, test.strs)
+		}
+	}
+}
@@ -2,16 +2,17 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"math"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	mapset "github.com/deckarep/golang-set"
 	"github.com/gorilla/websocket"
 	"github.com/hashicorp/go-version"
 )
@@ -58,55 +59,114 @@ var upgrader = websocket.Upgrader{
 const (
 	CONNECTED    uint32 = 1
 	WAIT_IRC_RPL uint32 = 2
+	KICKED       uint32 = 4
 )
 
+var clientIDCounter int64
+
 // Client is a connected user instance
 type Client struct {
-	user    *User
-	version *version.Version
+	id       int64 // connection id, unique while the server is running
+	user     *User
+	version  *version.Version
+	protocol int
 
 	conn *websocket.Conn
 
-	sendToWs       chan []byte
-	sendBinaryToWS chan []byte
-	quitWritePump  chan bool
+	sendQueue     *sendQueue
+	quitWritePump chan bool
 
 	//var
-	recentTime          time.Time
-	sentIrcMessageCount int32
+	recentTime time.Time
 
 	status uint32
+
+	capabilities mapset.Set
+
+	//v2 protocol
+	session        *Session
+	tokenRequest   *WSRequest
+
+	//pairing
+	device      *Device
+	deviceName  string
+	pairingCode string
+
+	//loaded on connect, refreshed by !set
+	prefsMu sync.Mutex
+	prefs   Preferences
 }
 
 func (c *Client) SendBinaryToWS(bin []byte) {
-	c.sendBinaryToWS <- bin
+	c.enqueue(wsFrame{msgType: websocket.BinaryMessage, data: bin})
 }
 
 func (c *Client) SendMessageToWS(text string) {
+	if c.protocol == PROTOCOL_V2 {
+		if frame, ok := c.session.record(ENVELOPE_CHAT, 0, TextData{Text: text}, text); ok {
+			c.enqueue(frame)
+		}
+		return
+	}
+
 	var textBytes = []byte(text)
-	c.sendToWs <- textBytes
+	c.enqueue(wsFrame{msgType: websocket.TextMessage, data: textBytes})
 }
 
 func (c *Client) SendNoticeToWS(text string) {
+	if c.protocol == PROTOCOL_V2 {
+		c.sendEnvelope(ENVELOPE_NOTICE, 0, TextData{Text: text})
+		return
+	}
+
 	var buffer bytes.Buffer
 	buffer.Write(syncNoticeHeader)
 	buffer.WriteString(text)
-	c.sendToWs <- buffer.Bytes()
+	c.enqueue(wsFrame{msgType: websocket.TextMessage, data: buffer.Bytes()})
+}
+
+// SendTokenToWS answers the pending token request of the client.
+func (c *Client) SendTokenToWS(token string) {
+	req := c.tokenRequest
+	if req == nil {
+		req = &WSRequest{Opcode: REQ_TOKEN}
+	}
+	c.Reply(req, RPL_TOKEN, TokenReply{Token: token})
+}
+
+func (c *Client) SendMessageToIRC(text string) bool {
+	return ircManager.SendMessage(c.user.Username, text)
 }
 
-func (c *Client) SendMessageToIRC(text string) {
-	ircManager.SendMessage(c.user.Username, text)
+// SendPriorityMessageToIRC sends a message ahead of the queued chat.
+func (c *Client) SendPriorityMessageToIRC(text string) bool {
+	return ircManager.SendPriorityMessage(c.user.Username, text)
+}
+
+// messageDropped tells the client a message didn't fit in the outbound IRC queue
+// and gives back the quota it took.
+func (c *Client) messageDropped(replyTo uint64, parts int32) {
+	userBukkit.ReturnMessageQuota(c.user.Username, parts)
+
+	const text = "Too many of your messages are waiting to be sent to osu!, the message is dropped."
+	if c.protocol == PROTOCOL_V2 {
+		c.sendErrorEnvelope(replyTo, ERROR_QUEUE_FULL, text)
+		return
+	}
+	c.SendNoticeToWS(text)
 }
 
 const timeLayoutOSU = "2006-01-02 15:04:05"
 
 //Process RTPPD Notify
-func (c *Client) processRtppdMsg(msg []byte) {
+func (c *Client) processRtppdMsg(replyTo uint64, parts int32, msg []byte) {
 	match := rtppdMsgRegex.FindSubmatch(msg)
 
 	defer func(){
 		log.Infof("[WS -> IRC] %s: %s", c.user.Username, msg)
-		c.SendMessageToIRC(string(msg))
+		if !c.SendPriorityMessageToIRC(string(msg)) {
+			c.messageDropped(replyTo, parts)
+		}
 	}()
 
 	if len(match) > 0 {
@@ -124,12 +184,12 @@ func (c *Client) processRtppdMsg(msg []byte) {
 				}
 			}
 
-			b, ok := osuAPI.GetBeatmap(beatmapID)
+			b, ok := osuAPI.GetBeatmap(beatmapID, mode)
 			if !ok {
 				return
 			}
 
-			if b["approved"].(string) != "1" {
+			if approved, ok := b["approved"].(string); !ok || approved != "1" {
 				return
 			}
 
@@ -140,7 +200,11 @@ func (c *Client) processRtppdMsg(msg []byte) {
 				if !ok {
 					return
 				}
-				t, err := time.Parse(timeLayoutOSU, recent["date"].(string))
+				date, ok := recent["date"].(string)
+				if !ok {
+					return
+				}
+				t, err := time.Parse(timeLayoutOSU, date)
 				if err != nil {
 					return
 				}
@@ -183,6 +247,19 @@ func (c *Client) processRtppdMsg(msg []byte) {
 
 			userManager.Update(c.user)
 
+			if c.Can(CAP_PP_UPDATE) {
+				c.sendEnvelope(ENVELOPE_PP_UPDATE, 0, PPUpdateData{
+					BeatmapID: beatmapID,
+					Mode:      mode,
+					PP:        pp,
+					Delta:     deltaPP,
+				})
+			}
+
+			if !c.Preferences().PPDelta {
+				return
+			}
+
 			var buffer bytes.Buffer
 			buffer.Write(msg)
 			fmt.Fprintf(&buffer, " (%+.2fpp)", deltaPP)
@@ -192,11 +269,84 @@ func (c *Client) processRtppdMsg(msg []byte) {
 	}
 }
 
+func (c *Client) processChatMessage(replyTo uint64, message []byte) {
+	if !c.Paired() {
+		if c.protocol == PROTOCOL_V2 {
+			c.sendErrorEnvelope(replyTo, ERROR_NOT_PAIRED, "This Sync is not paired with your osu! account.")
+			return
+		}
+		c.SendNoticeToWS("This Sync is not paired with your osu! account.")
+		return
+	}
+
+	message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+
+	//every part of a long message counts
+	parts := int32(len(splitIRCMessage(string(message), ircMaxMessageBytes)))
+	if !userBukkit.TakeMessageQuota(c.user.Username, parts) {
+		if c.protocol == PROTOCOL_V2 {
+			c.sendErrorEnvelope(replyTo, ERROR_RATE_LIMITED, "Exceeded the limit on the number of messages sent per minute.")
+			return
+		}
+		c.SendMessageToWS("Exceeded the limit on the number of messages sent per minute.")
+		return
+	}
+
+	if !ircManager.IsOnline(c.user.Username) {
+		log.Infof("[WS -> IRC(offline)] %s: %s", c.user.Username, message)
+		return
+	}
+
+	//process RTPPD message
+	if bytes.HasPrefix(message, []byte("[RTPPD]")) {
+		go c.processRtppdMsg(replyTo, parts, message)
+	} else {
+		log.Infof("[WS -> IRC] %s: %s", c.user.Username, message)
+		if !c.SendMessageToIRC(string(message)) {
+			c.messageDropped(replyTo, parts)
+		}
+	}
+}
+
+func (c *Client) requestToken(req *WSRequest) {
+	if !c.Paired() {
+		c.ReplyError(req, ERROR_NOT_PAIRED, "This Sync is not paired with your osu! account.")
+		return
+	}
+	if (c.status & WAIT_IRC_RPL) > 0 {
+		c.ReplyError(req, ERROR_BUSY, "A token request is already waiting for a reply from IRC.")
+		return
+	}
+
+	c.tokenRequest = req
+	c.SendMessageToIRC(`Sync wants to request other services that the Token uses to access the Bot. Reply "!assign_token" to generate and send a token to Sync.`)
+	c.status |= WAIT_IRC_RPL
+	time.AfterFunc(60*time.Second, func() {
+		c.status &= ^WAIT_IRC_RPL
+	})
+}
+
+// resumable reports whether the client may come back and resume its session after err.
+func (c *Client) resumable(err error) bool {
+	if c.session == nil || config.ResumeGracePeriod <= 0 || (c.status&KICKED) > 0 {
+		return false
+	}
+	return !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+}
+
 func (c *Client) readPumpWS() {
+	var readErr error
 	defer func() {
 		userBukkit.remove <- c
-		if tokenManager.TokenRequested(c) {
-			tokenManager.RemoveToken(c)
+		if c.resumable(readErr) {
+			sessionManager.Detach(c)
+		} else {
+			if c.session != nil {
+				sessionManager.Remove(c.session)
+			}
+			if tokenManager.TokenRequested(c) {
+				tokenManager.RemoveToken(c)
+			}
 		}
 		c.conn.Close()
 	}()
@@ -209,6 +359,7 @@ func (c *Client) readPumpWS() {
 		msgType, message, err := c.conn.ReadMessage()
 
 		if err != nil {
+			readErr = err
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Warningf("%s : %v", c.user.Username, err)
 			}
@@ -218,6 +369,11 @@ func (c *Client) readPumpWS() {
 
 		switch msgType {
 		case websocket.TextMessage:
+			if c.protocol == PROTOCOL_V2 {
+				c.processEnvelope(message)
+				continue
+			}
+
 			//compatibility
 			if bytes.HasPrefix(message, heartPingFlag) {
 				c.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -225,39 +381,10 @@ func (c *Client) readPumpWS() {
 				continue
 			}
 
-			if c.sentIrcMessageCount > config.MaxMessageCountPerMinute {
-				c.SendMessageToWS("Exceeded the limit on the number of messages sent per minute.")
-				continue
-			}
-			atomic.AddInt32(&c.sentIrcMessageCount, 1)
-			message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-
-			if !ircManager.IsOnline(c.user.Username) {
-				log.Infof("[WS -> IRC(offline)] %s: %s", c.user.Username, message)
-				continue
-			}
-
-			//process RTPPD message
-			if bytes.HasPrefix(message, []byte("[RTPPD]")) {
-				go c.processRtppdMsg(message)
-			} else {
-				log.Infof("[WS -> IRC] %s: %s", c.user.Username, message)
-				c.SendMessageToIRC(string(message))
-			}
+			c.processChatMessage(0, message)
 		case websocket.BinaryMessage:
-			if len(message) >= 2 {
-				if (c.status & WAIT_IRC_RPL) > 0 {
-					continue
-				}
-
-				cmd := binary.LittleEndian.Uint16(message)
-				if cmd == REQ_TOKEN {
-					c.SendMessageToIRC(`Sync wants to request other services that the Token uses to access the Bot. Reply "!assign_token" to generate and send a token to Sync.`)
-					c.status |= WAIT_IRC_RPL
-					time.AfterFunc(60*time.Second, func() {
-						c.status &= ^WAIT_IRC_RPL
-					})
-				}
+			if req, ok := c.parseWSRequest(message); ok {
+				wsCommandManager.Dispatch(c, req)
 			}
 		}
 	}
@@ -265,33 +392,31 @@ func (c *Client) readPumpWS() {
 
 func (c *Client) writePumpWS() {
 	pingTicker := time.NewTicker(pingPeriod)
-	msgCountClearTicker := time.NewTicker(time.Minute)
 	defer func() {
 		pingTicker.Stop()
-		msgCountClearTicker.Stop()
 		c.conn.Close()
 	}()
 
 	for {
 		select {
-		case msgBytes, ok := <-c.sendToWs:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+		case <-c.sendQueue.notify:
+			for {
+				frame, ok := c.sendQueue.pop()
+				if !ok {
+					break
+				}
 
-			c.conn.WriteMessage(websocket.TextMessage, msgBytes)
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if frame.msgType == websocket.CloseMessage {
+					c.conn.WriteMessage(websocket.CloseMessage, frame.data)
+					return
+				}
 
-		case binBytes, ok := <-c.sendBinaryToWS:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+				if err := c.conn.WriteMessage(frame.msgType, frame.data); err == nil && frame.seq > 0 {
+					c.session.ack(frame.seq)
+				}
 			}
 
-			c.conn.WriteMessage(websocket.BinaryMessage, binBytes)
-
 		case <-pingTicker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -300,14 +425,6 @@ func (c *Client) writePumpWS() {
 
 		case <-c.quitWritePump:
 			return
-
-		case <-msgCountClearTicker.C:
-			oldValue := c.sentIrcMessageCount
-			for {
-				if atomic.CompareAndSwapInt32(&c.sentIrcMessageCount, oldValue, 0) {
-					break
-				}
-			}
 		}
 	}
 }
@@ -355,7 +472,20 @@ func getUser(name string) (*User, bool) {
 	return user, true
 }
 
-func StartWS(name string, w http.ResponseWriter, r *http.Request, ver *version.Version) {
+// ConnectRequest is the handshake of a Sync client, read from the cookies.
+type ConnectRequest struct {
+	Name         string
+	Version      *version.Version
+	Resume       *ResumeRequest
+	DeviceSecret string
+	DeviceName   string
+}
+
+func StartWS(req *ConnectRequest, w http.ResponseWriter, r *http.Request) {
+	name := req.Name
+	ver := req.Version
+	resume := req.Resume
+
 	user, ok := getUser(name)
 	if !ok {
 		r.Body.Close()
@@ -368,6 +498,19 @@ func StartWS(name string, w http.ResponseWriter, r *http.Request, ver *version.V
 		return
 	}
 
+	if ok, _ := ircManager.Authenticated(); !ok {
+		reason := "The bot isn't logged in to Bancho, try again later."
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason))
+		conn.Close()
+		return
+	}
+
+	if reason := checkPluginVersion(ver); len(reason) > 0 {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+		conn.Close()
+		return
+	}
+
 	if user.IsBanned() {
 		eta := user.GetBannedETA()
 		if eta != 0 {
@@ -382,28 +525,90 @@ func StartWS(name string, w http.ResponseWriter, r *http.Request, ver *version.V
 		userManager.Update(user)
 	}
 
-	if userBukkit.IsOnline(name) {
-		reason := fmt.Sprintf(`The TargetUsername is connected! Send "!logout" logout the user to %s`, config.Username)
-		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
-		conn.Close()
+	protocol := PROTOCOL_LEGACY
+	if !ver.LessThan(PROTOCOL_V2_VERSION) {
+		protocol = PROTOCOL_V2
 	}
 
 	c := &Client{
+		id:             atomic.AddInt64(&clientIDCounter, 1),
 		version:        ver,
+		protocol:       protocol,
 		user:           user,
 		conn:           conn,
-		sendToWs:       make(chan []byte, 64),
-		sendBinaryToWS: make(chan []byte, 64),
-		quitWritePump:  make(chan bool),
+		sendQueue:      newSendQueue(),
+		quitWritePump:  make(chan bool, 1),
 		status:         CONNECTED,
+		capabilities:   defaultCapabilities(ver),
+		prefs:          userManager.GetPreferences(user.UID),
 	}
 
-	userBukkit.add <- c
+	if !userBukkit.Add(c) {
+		reason := fmt.Sprintf(`The TargetUsername has %d connected Sync! Send "!logout" logout the user to %s`, config.MaxClientsPerUser, config.BotNick())
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+		conn.Close()
+		return
+	}
+
+	var resumed *Session
+	if protocol == PROTOCOL_V2 {
+		if resume != nil {
+			resumed, _ = sessionManager.Resume(resume.ID, user.UID, c)
+		}
+		if resumed != nil {
+			c.session = resumed
+		} else {
+			c.session = sessionManager.New(c)
+		}
+	}
+
+	go c.writePumpWS()
 
-	c.SendNoticeToWS(config.WelcomeMessage)
-	c.SendNoticeToWS(fmt.Sprintf("You can send %d messages per minute", config.MaxMessageCountPerMinute))
+	c.SendCapabilitiesToWS()
+
+	if resumed != nil {
+		frames, lost := resumed.missed(resume.Seq)
+		for _, frame := range frames {
+			c.enqueue(frame)
+		}
+		c.sendEnvelope(ENVELOPE_SESSION, 0, SessionData{
+			ResumeID: resumed.id,
+			Resumed:  true,
+			Replayed: len(frames),
+			Lost:     lost,
+		})
+		go c.readPumpWS()
+		return
+	}
+
+	if c.session != nil && config.ResumeGracePeriod > 0 {
+		c.sendEnvelope(ENVELOPE_SESSION, 0, SessionData{ResumeID: c.session.id})
+	}
+
+	welcome := c.Preferences().Welcome
+	if welcome {
+		c.SendNoticeToWS(config.WelcomeMessage)
+		c.SendNoticeToWS(fmt.Sprintf("You can send %d messages per minute", config.MaxMessageCountPerMinute))
+	}
+	if isDeprecatedPluginVersion(ver) {
+		c.SendNoticeToWS(fmt.Sprintf("Your PublicOsuBotTransfer plugin %s is deprecated and will stop working soon. Please update it to %s or later.", ver, deprecatedPluginVersion))
+	}
+	if welcome {
+		c.SendNoticeToWS(fmt.Sprintf(`This is connection #%d. Send "!logout %d" to %s to close only this one.`, c.id, c.id, config.BotNick()))
+	}
+
+	if len(req.DeviceSecret) > 0 {
+		c.device, _ = userManager.GetDeviceBySecret(user.UID, hashDeviceSecret(req.DeviceSecret))
+	}
+
+	if c.Paired() {
+		userManager.TouchDevice(c.device)
+		c.deliverMails()
+	} else {
+		c.deviceName = req.DeviceName
+		c.startPairing()
+	}
 	//c.sendMessageToIrc(config.WelcomeMessage)
 
 	go c.readPumpWS()
-	go c.writePumpWS()
 }
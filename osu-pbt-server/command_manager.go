@@ -1,17 +1,37 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"golang.org/x/crypto/ssh/terminal"
 	"io"
 	"os"
+	"sort"
 	"strings"
+	"text/tabwriter"
 )
 
 type RegisterCommand struct {
-	callback  func(string, []string, io.Writer)
-	detail    string
-	argsCount int
+	path     []string
+	specs    []ArgSpec
+	detail   string
+	role     int // required role of the caller
+	callback func(string, CommandArgs, io.Writer)
+}
+
+// Usage is generated from the registered usage, e.g. "user info <username>".
+func (rc *RegisterCommand) Usage() string {
+	parts := append([]string{}, rc.path...)
+	for _, spec := range rc.specs {
+		parts = append(parts, spec.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// commandNode is a level of the command tree, "user info" is the child info of user.
+type commandNode struct {
+	command  *RegisterCommand
+	children map[string]*commandNode
 }
 
 type Command struct {
@@ -21,17 +41,97 @@ type Command struct {
 }
 
 type CommandManager struct {
-	cmds        map[string]RegisterCommand
+	root        *commandNode
+	prefix      string // typed before a command, shown in usages
+	roleOf      func(from string) int // nil if every caller is an admin, like stdin
 	pushCommand chan Command
 	oldTerminalState 	*terminal.State
 }
 
-func (cm *CommandManager) AddCallback(key string, callback func(string, []string, io.Writer), detail string, argsCount int) {
-	cm.cmds[key] = RegisterCommand{
-		callback:  callback,
-		detail:    detail,
-		argsCount: argsCount,
+// AddCommand registers a command by its usage, the words before the first argument are the
+// command path, arguments are <name:type> or [name:type] with an optional ... for the rest of the line.
+func (cm *CommandManager) AddCommand(usage string, detail string, callback func(string, CommandArgs, io.Writer)) {
+	cm.AddCommandWithRole(usage, detail, ROLE_USER, callback)
+}
+
+// AddCommandWithRole registers a command only callers with the role can run, invocations are logged.
+func (cm *CommandManager) AddCommandWithRole(usage string, detail string, role int, callback func(string, CommandArgs, io.Writer)) {
+	path, specs := parseUsage(usage)
+	if len(path) == 0 {
+		panic(fmt.Sprintf("command usage %q: no command name", usage))
+	}
+
+	node := cm.root
+	for _, name := range path {
+		child, ok := node.children[name]
+		if !ok {
+			child = &commandNode{children: make(map[string]*commandNode)}
+			node.children[name] = child
+		}
+		node = child
+	}
+	node.command = &RegisterCommand{
+		path:     path,
+		specs:    specs,
+		detail:   detail,
+		role:     role,
+		callback: callback,
+	}
+}
+
+// Role returns the role of a caller.
+func (cm *CommandManager) Role(from string) int {
+	if cm.roleOf == nil {
+		return ROLE_ADMIN
+	}
+	return cm.roleOf(from)
+}
+
+// Commands returns all registered commands sorted by usage.
+func (cm *CommandManager) Commands() []*RegisterCommand {
+	return collectCommands(cm.root)
+}
+
+// CommandsFor returns the commands a caller with the role can run.
+func (cm *CommandManager) CommandsFor(role int) []*RegisterCommand {
+	return commandsFor(cm.Commands(), role)
+}
+
+func commandsFor(all []*RegisterCommand, role int) []*RegisterCommand {
+	cmds := []*RegisterCommand{}
+	for _, cmd := range all {
+		if cmd.role <= role {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+func collectCommands(node *commandNode) []*RegisterCommand {
+	cmds := []*RegisterCommand{}
+	if node.command != nil {
+		cmds = append(cmds, node.command)
+	}
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmds = append(cmds, collectCommands(node.children[name])...)
 	}
+	return cmds
+}
+
+// printUsages writes the usage and detail of the commands in aligned columns.
+func (cm *CommandManager) printUsages(o io.Writer, cmds []*RegisterCommand) {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, "%s%s\t%s\n", cm.prefix, cmd.Usage(), cmd.detail)
+	}
+	w.Flush()
+	fmt.Fprint(o, strings.Replace(buf.String(), "\n", "\n\r", -1))
 }
 
 func (cm *CommandManager) PushCommand(from string, text string) {
@@ -39,22 +139,164 @@ func (cm *CommandManager) PushCommand(from string, text string) {
 }
 
 func (cm *CommandManager) PushCommandEx(from string, cmd string, o io.Writer) {
-	args := strings.Split(cmd, " ")
-	if len(args) < 0 {
+	tokens, err := tokenize(cmd)
+	if err != nil {
+		fmt.Fprintf(o, "Can't parse the command, %s.\n\r", err)
+		return
+	}
+	if len(tokens) == 0 {
 		return
 	}
 
-	if rcmd, exist := cm.cmds[args[0]]; exist {
-		if len(args)-1 < rcmd.argsCount {
-			fmt.Fprintf(o, "Not enough parameters. (%d/%d)\n\r", len(args)-1, rcmd.argsCount)
+	node := cm.root
+	i := 0
+	for ; i < len(tokens); i++ {
+		child, ok := node.children[tokens[i]]
+		if !ok {
+			break
+		}
+		node = child
+	}
+
+	if node == cm.root {
+		if _, ok := cm.root.children["help"]; ok {
+			fmt.Fprintf(o, "Unknown command %s%s, send %shelp to see the commands.\n\r", cm.prefix, tokens[0], cm.prefix)
 			return
 		}
-		rcmd.callback(from, args[1:], o)
-	} else {
 		fmt.Fprintf(o, "Command no exist!\n\r")
+		return
+	}
+
+	rcmd := node.command
+	if rcmd == nil {
+		all := collectCommands(node)
+		cmds := commandsFor(all, cm.Role(from))
+		if len(cmds) == 0 {
+			needed := ROLE_ADMIN
+			for _, cmd := range all {
+				if cmd.role < needed {
+					needed = cmd.role
+				}
+			}
+			fmt.Fprintf(o, "%s%s needs the %s role.\n\r", cm.prefix, strings.Join(tokens[:i], " "), roleNames[needed])
+			return
+		}
+		fmt.Fprintf(o, "Usage:\n\r")
+		cm.printUsages(o, cmds)
+		return
+	}
+
+	if err := cm.run(from, rcmd, tokens[i:], cmd, o); err != nil {
+		if len(err.Usage) > 0 {
+			fmt.Fprintf(o, "%s.\n\rUsage: %s%s\n\r", err.Message, cm.prefix, err.Usage)
+		} else {
+			fmt.Fprintf(o, "%s.\n\r", err.Message)
+		}
 	}
 }
 
+// CommandError is why a command didn't run, Usage is set if the arguments are wrong.
+type CommandError struct {
+	Message string
+	Usage   string
+}
+
+func (e *CommandError) Error() string {
+	return e.Message
+}
+
+// CommandResult is implemented by outputs that want the result of a command
+// besides what it prints, like the admin api.
+type CommandResult interface {
+	SetResult(v interface{})
+	Fail(message string)
+}
+
+// setCommandResult reports the result of a command to an output that wants it.
+func setCommandResult(o io.Writer, v interface{}) {
+	if r, ok := o.(CommandResult); ok {
+		r.SetResult(v)
+	}
+}
+
+// failCommand prints why a command failed and reports it to an output that wants the result.
+func failCommand(o io.Writer, format string, a ...interface{}) {
+	message := fmt.Sprintf(format, a...)
+	fmt.Fprint(o, message)
+	if r, ok := o.(CommandResult); ok {
+		r.Fail(strings.TrimRight(message, "\n\r"))
+	}
+}
+
+// run checks the role of the caller, parses the arguments and calls the command, line is logged.
+func (cm *CommandManager) run(from string, rcmd *RegisterCommand, tokens []string, line string, o io.Writer) *CommandError {
+	role := cm.Role(from)
+	if role < rcmd.role {
+		log.Warningf("[Command] %s(%s) isn't allowed to run %s%s", from, roleNames[role], cm.prefix, line)
+		return &CommandError{Message: fmt.Sprintf("%s%s needs the %s role", cm.prefix, strings.Join(rcmd.path, " "), roleNames[rcmd.role])}
+	}
+
+	args, err := parseArgs(rcmd.specs, tokens)
+	if err != nil {
+		return &CommandError{Message: err.Error(), Usage: rcmd.Usage()}
+	}
+
+	if rcmd.role > ROLE_USER {
+		log.Infof("[Command] %s(%s) ran %s%s", from, roleNames[role], cm.prefix, line)
+	}
+	rcmd.callback(from, args, o)
+	return nil
+}
+
+// Find returns the command registered at the path, e.g. "user info".
+func (cm *CommandManager) Find(path string) (*RegisterCommand, bool) {
+	node := cm.root
+	for _, name := range strings.Fields(path) {
+		child, ok := node.children[name]
+		if !ok {
+			return nil, false
+		}
+		node = child
+	}
+	return node.command, node != cm.root && node.command != nil
+}
+
+// RunNamed runs a command with its arguments by name instead of a command line,
+// they are checked the same way.
+func (cm *CommandManager) RunNamed(from string, rcmd *RegisterCommand, named map[string]string, o io.Writer) *CommandError {
+	tokens := []string{}
+	var skipped *ArgSpec
+	for i, spec := range rcmd.specs {
+		value, ok := named[spec.Name]
+		if !ok || len(value) == 0 {
+			if !spec.Optional {
+				return &CommandError{Message: fmt.Sprintf("%s is missing", spec), Usage: rcmd.Usage()}
+			}
+			if skipped == nil {
+				skipped = &rcmd.specs[i]
+			}
+			continue
+		}
+		if skipped != nil {
+			return &CommandError{Message: fmt.Sprintf("%s is missing, it comes before %s", skipped, spec), Usage: rcmd.Usage()}
+		}
+		tokens = append(tokens, value)
+	}
+
+	for name := range named {
+		known := false
+		for _, spec := range rcmd.specs {
+			known = known || spec.Name == name
+		}
+		if !known {
+			return &CommandError{Message: fmt.Sprintf("unknown argument %s", name), Usage: rcmd.Usage()}
+		}
+	}
+
+	line := strings.Join(append(append([]string{}, rcmd.path...), tokens...), " ")
+	return cm.run(from, rcmd, tokens, line, o)
+}
+
 func (cm *CommandManager) ReadStdinPump() {
 	cm.oldTerminalState,_ = terminal.MakeRaw(int(os.Stdin.Fd()))
 
@@ -77,18 +319,44 @@ func (cm *CommandManager) QuitStdinPump(){
 	terminal.Restore(int(os.Stdin.Fd()),cm.oldTerminalState)
 }
 
-func NewCommandManager(addHelp bool) *CommandManager {
+// NewCommandManager creates a command manager, prefix is typed before commands, e.g. "!" on IRC.
+func NewCommandManager(prefix string, addHelp bool) *CommandManager {
 	cm := &CommandManager{
-		cmds:        make(map[string]RegisterCommand),
+		root:        &commandNode{children: make(map[string]*commandNode)},
+		prefix:      prefix,
 		pushCommand: make(chan Command, 64),
 	}
 
 	if addHelp {
-		cm.AddCallback("help", func(from string, args []string, o io.Writer) {
-			for k, v := range cm.cmds {
-				fmt.Fprintf(o, "%s\t%s\n\r", k, v.detail)
+		cm.AddCommand("help [command...]", "Show the commands, or the usage of one", func(from string, args CommandArgs, o io.Writer) {
+			cmds := cm.CommandsFor(cm.Role(from))
+			if args.Has("command") {
+				matched := []*RegisterCommand{}
+				for _, cmd := range cmds {
+					path := strings.Join(cmd.path, " ")
+					if path == args.String("command") || strings.HasPrefix(path, args.String("command")+" ") {
+						matched = append(matched, cmd)
+					}
+				}
+				if len(matched) == 0 {
+					fmt.Fprintf(o, "Unknown command %s%s.\n\r", cm.prefix, args.String("command"))
+					return
+				}
+				cm.printUsages(o, matched)
+				return
+			}
+
+			//chat commands get a single line, a console a table
+			if len(cm.prefix) > 0 {
+				names := []string{}
+				for _, cmd := range cmds {
+					names = append(names, cm.prefix+strings.Join(cmd.path, " "))
+				}
+				fmt.Fprintf(o, "Commands: %s. Send %shelp <command> to see how to use one.\n\r", strings.Join(names, ", "), cm.prefix)
+				return
 			}
-		}, "\t\t\tShow help", 0)
+			cm.printUsages(o, cmds)
+		})
 	}
 
 	return cm
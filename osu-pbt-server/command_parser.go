@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Argument types of a command usage.
+const (
+	ARG_STRING   = "string"
+	ARG_INT      = "int"      // a "#" prefix is allowed, for connection and device ids
+	ARG_DURATION = "duration" // 30m, 2h, 1d or minutes
+	ARG_USERNAME = "user"
+)
+
+var usernameRegex = regexp.MustCompile(`^[\w \-\[\]]{1,15}$`)
+
+// ArgSpec is an argument of a command usage like "<username:user> [id:int] <msg...>".
+type ArgSpec struct {
+	Name     string
+	Type     string
+	Optional bool
+	Variadic bool // takes the rest of the line
+}
+
+func (spec ArgSpec) String() string {
+	name := spec.Name
+	if spec.Variadic {
+		name += "..."
+	}
+	if spec.Optional {
+		return "[" + name + "]"
+	}
+	return "<" + name + ">"
+}
+
+// parseUsage splits a usage into the command path and its argument specs.
+// It panics on a malformed usage, usages are constants.
+func parseUsage(usage string) ([]string, []ArgSpec) {
+	path := []string{}
+	specs := []ArgSpec{}
+
+	for _, field := range strings.Fields(usage) {
+		if !strings.HasPrefix(field, "<") && !strings.HasPrefix(field, "[") {
+			if len(specs) > 0 {
+				panic(fmt.Sprintf("command usage %q: subcommand after an argument", usage))
+			}
+			path = append(path, field)
+			continue
+		}
+
+		spec := ArgSpec{Type: ARG_STRING}
+		switch {
+		case strings.HasPrefix(field, "<") && strings.HasSuffix(field, ">"):
+		case strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]"):
+			spec.Optional = true
+		default:
+			panic(fmt.Sprintf("command usage %q: bad argument %s", usage, field))
+		}
+		field = field[1 : len(field)-1]
+
+		if strings.HasSuffix(field, "...") {
+			spec.Variadic = true
+			field = strings.TrimSuffix(field, "...")
+		}
+		if i := strings.Index(field, ":"); i >= 0 {
+			spec.Type = field[i+1:]
+			field = field[:i]
+		}
+		spec.Name = field
+
+		switch spec.Type {
+		case ARG_STRING, ARG_INT, ARG_DURATION, ARG_USERNAME:
+		default:
+			panic(fmt.Sprintf("command usage %q: unknown type %s", usage, spec.Type))
+		}
+		if len(specs) > 0 {
+			last := specs[len(specs)-1]
+			if last.Variadic || (last.Optional && !spec.Optional) {
+				panic(fmt.Sprintf("command usage %q: %s can't follow %s", usage, spec, last))
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return path, specs
+}
+
+// tokenize splits a command line on spaces,
+// "double" and 'single' quotes group words and a backslash escapes the next character.
+func tokenize(line string) ([]string, error) {
+	tokens := []string{}
+	var token strings.Builder
+	inToken := false
+	var quote rune
+	escaped := false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			token.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inToken = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				token.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inToken = true
+		case r == ' ' || r == '\t':
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(r)
+			inToken = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("missing closing %c", quote)
+	}
+	if escaped {
+		return nil, fmt.Errorf("nothing to escape at the end")
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return tokens, nil
+}
+
+// parseDuration accepts Go durations, a "d" suffix for days, and plain numbers as minutes.
+func parseDuration(s string) (time.Duration, error) {
+	if minutes, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(minutes) * time.Minute, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseInt(strings.TrimSuffix(s, "d"), 10, 64)
+		if err == nil {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// CommandArgs are the typed arguments of a command, by name.
+type CommandArgs struct {
+	values map[string]interface{}
+}
+
+func (a CommandArgs) Has(name string) bool {
+	_, ok := a.values[name]
+	return ok
+}
+
+func (a CommandArgs) String(name string) string {
+	s, _ := a.values[name].(string)
+	return s
+}
+
+func (a CommandArgs) Int(name string) int64 {
+	i, _ := a.values[name].(int64)
+	return i
+}
+
+func (a CommandArgs) Duration(name string) time.Duration {
+	d, _ := a.values[name].(time.Duration)
+	return d
+}
+
+// parseArgs converts the tokens after the command path by the specs.
+func parseArgs(specs []ArgSpec, tokens []string) (CommandArgs, error) {
+	args := CommandArgs{values: make(map[string]interface{})}
+
+	for i, spec := range specs {
+		if i >= len(tokens) {
+			if spec.Optional {
+				break
+			}
+			return args, fmt.Errorf("%s is missing", spec)
+		}
+
+		token := tokens[i]
+		if spec.Variadic {
+			token = strings.Join(tokens[i:], " ")
+		}
+
+		switch spec.Type {
+		case ARG_INT:
+			value, err := strconv.ParseInt(strings.TrimPrefix(token, "#"), 10, 64)
+			if err != nil {
+				return args, fmt.Errorf("%s must be a number, not %q", spec, token)
+			}
+			args.values[spec.Name] = value
+		case ARG_DURATION:
+			value, err := parseDuration(token)
+			if err != nil || value <= 0 {
+				return args, fmt.Errorf("%s must be a duration like 30m, 2h or 1d, not %q", spec, token)
+			}
+			args.values[spec.Name] = value
+		case ARG_USERNAME:
+			if !usernameRegex.MatchString(token) {
+				return args, fmt.Errorf("%s must be an osu! username, not %q", spec, token)
+			}
+			//users are stored with underscores, like the names from Sync and IRC
+			args.values[spec.Name] = strings.Replace(token, " ", "_", -1)
+		default:
+			args.values[spec.Name] = token
+		}
+	}
+
+	if len(tokens) > len(specs) && (len(specs) == 0 || !specs[len(specs)-1].Variadic) {
+		return args, fmt.Errorf("too many arguments")
+	}
+	return args, nil
+}
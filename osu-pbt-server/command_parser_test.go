@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		line   string
+		tokens []string
+		err    bool
+	}{
+		{"", []string{}, false},
+		{"  ban  peppy 1d ", []string{"ban", "peppy", "1d"}, false},
+		{`tosync peppy "hello world"`, []string{"tosync", "peppy", "hello world"}, false},
+		{`say 'a "quoted" word'`, []string{"say", `a "quoted" word`}, false},
+		{`say "it's"`, []string{"say", "it's"}, false},
+		{`user info Some\ One`, []string{"user", "info", "Some One"}, false},
+		{`say "a \"b\""`, []string{"say", `a "b"`}, false},
+		{`say 'a\b'`, []string{"say", `a\b`}, false},
+		{`say ""`, []string{"say", ""}, false},
+		{`say a"b c"d`, []string{"say", "ab cd"}, false},
+		{"say\ttab", []string{"say", "tab"}, false},
+		{`say "open`, nil, true},
+		{`say 'open`, nil, true},
+		{`say end\`, nil, true},
+	}
+
+	for _, test := range tests {
+		tokens, err := tokenize(test.line)
+		if (err != nil) != test.err {
+			t.Errorf("tokenize(%q) error = %v, want error %v", test.line, err, test.err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.line, tokens, test.tokens)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		s   string
+		d   time.Duration
+		err bool
+	}{
+		{"30", 30 * time.Minute, false},
+		{"0", 0, false},
+		{"30m", 30 * time.Minute, false},
+		{"2h", 2 * time.Hour, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"1d", 24 * time.Hour, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"90s", 90 * time.Second, false},
+		{"1.5d", 0, true},
+		{"d", 0, true},
+		{"soon", 0, true},
+		{"", 0, true},
+	}
+
+	for _, test := range tests {
+		d, err := parseDuration(test.s)
+		if (err != nil) != test.err {
+			t.Errorf("parseDuration(%q) error = %v, want error %v", test.s, err, test.err)
+			continue
+		}
+		if !test.err && d != test.d {
+			t.Errorf("parseDuration(%q) = %s, want %s", test.s, d, test.d)
+		}
+	}
+}
+
+func TestParseUsage(t *testing.T) {
+	path, specs := parseUsage("user info <username:user> [id:int] [msg...]")
+	if !reflect.DeepEqual(path, []string{"user", "info"}) {
+		t.Errorf("path = %q", path)
+	}
+	want := []ArgSpec{
+		{Name: "username", Type: ARG_USERNAME},
+		{Name: "id", Type: ARG_INT, Optional: true},
+		{Name: "msg", Type: ARG_STRING, Optional: true, Variadic: true},
+	}
+	if !reflect.DeepEqual(specs, want) {
+		t.Errorf("specs = %+v, want %+v", specs, want)
+	}
+
+	malformed := []string{
+		"ban <username> now",
+		"ban <time:float>",
+		"ban <username",
+		"say <msg...> <to>",
+		"kick [id:int] <username>",
+	}
+	for _, usage := range malformed {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("parseUsage(%q) didn't panic", usage)
+				}
+			}()
+			parseUsage(usage)
+		}()
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	_, kick := parseUsage("kick <username:user> [id:int]")
+	_, ban := parseUsage("ban <username:user> <time:duration>")
+	_, tosync := parseUsage("tosync <username:user> <msg...>")
+
+	tests := []struct {
+		specs  []ArgSpec
+		tokens []string
+		values map[string]interface{}
+		err    bool
+	}{
+		{kick, []string{"peppy"}, map[string]interface{}{"username": "peppy"}, false},
+		{kick, []string{"peppy", "#3"}, map[string]interface{}{"username": "peppy", "id": int64(3)}, false},
+		{kick, []string{"peppy", "3"}, map[string]interface{}{"username": "peppy", "id": int64(3)}, false},
+		{kick, []string{"Some_One [x]"}, map[string]interface{}{"username": "Some_One_[x]"}, false},
+		{kick, []string{"Some One"}, map[string]interface{}{"username": "Some_One"}, false},
+		{ban, []string{"Some User", "1d"}, map[string]interface{}{"username": "Some_User", "time": 24 * time.Hour}, false},
+		{kick, []string{"peppy", "three"}, nil, true},
+		{kick, []string{"peppy", "1", "2"}, nil, true},
+		{kick, []string{}, nil, true},
+		{kick, []string{"bad/name"}, nil, true},
+		{kick, []string{"a_name_too_long_for_osu"}, nil, true},
+		{ban, []string{"peppy", "1d"}, map[string]interface{}{"username": "peppy", "time": 24 * time.Hour}, false},
+		{ban, []string{"peppy", "0"}, nil, true},
+		{ban, []string{"peppy", "-5m"}, nil, true},
+		{ban, []string{"peppy"}, nil, true},
+		{tosync, []string{"peppy", "hello", "there"}, map[string]interface{}{"username": "peppy", "msg": "hello there"}, false},
+		{tosync, []string{"peppy", "hello world"}, map[string]interface{}{"username": "peppy", "msg": "hello world"}, false},
+		{tosync, []string{"peppy"}, nil, true},
+	}
+
+	for _, test := range tests {
+		args, err := parseArgs(test.specs, test.tokens)
+		if (err != nil) != test.err {
+			t.Errorf("parseArgs(%v, %q) error = %v, want error %v", test.specs, test.tokens, err, test.err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(args.values, test.values) {
+			t.Errorf("parseArgs(%v, %q) = %v, want %v", test.specs, test.tokens, args.values, test.values)
+		}
+	}
+}
@@ -1,19 +1,80 @@
 package main
 
+import (
+	"net"
+	"strconv"
+)
+
 // Config is PBT-GO configuration struct
 type Config struct {
 	//irc
 	Username string `json:"ircBotName"`
 	Password string `json:"ircBotPassword"`
 
+	//irc endpoint
+	IRCServer   string `json:"ircServer"` // irc.ppy.sh if empty
+	IRCPort     int32  `json:"ircPort"`   // 6667, or 6697 with TLS, if 0
+	IRCTLS      bool   `json:"ircTLS"`
+	IRCCABundle string `json:"ircCABundle"` // PEM file, the system roots are used if empty
+	IRCNick     string `json:"ircNick"`     // ircBotName if empty
+
 	//ws
 	Port int32  `json:"port"`
 	Path string `json:"path"`
 
+	//plugin version policy
+	MinVersion      string `json:"minVersion"`      // older plugins are rejected
+	DeprecatedBelow string `json:"deprecatedBelow"` // older plugins are asked to upgrade
+
 	//bot
 	WelcomeMessage           string `josn:"welcomeMessage"`
 	MaxMessageCountPerMinute int32  `json:"maxMessageCountPerMinute"`
+	MaxClientsPerUser        int32  `json:"maxClientsPerUser"` // 0 is unlimited
+
+	//outbound irc limit of the whole bot
+	IRCSendRate  int32 `json:"ircSendRate"`  // messages per minute
+	IRCSendBurst int32 `json:"ircSendBurst"` // messages
+
+	//outbound queue of a client
+	SendQueueSize  int32  `json:"sendQueueSize"`  // frames
+	OverflowPolicy string `json:"overflowPolicy"` // drop-oldest, drop-newest or disconnect
 
 	//Osu Api
 	APIKey string `json:"apiKey"`
+
+	//admin http api, disabled if empty
+	AdminSecret string `json:"adminSecret"`
+
+	//session resumption
+	ResumeGracePeriod int32 `json:"resumeGracePeriod"` // seconds
+	ResumeBufferSize  int32 `json:"resumeBufferSize"`  // frames
+
+	//mailbox
+	MailboxSize int32 `json:"mailboxSize"` // max queued messages per user
+	MailboxTTL  int32 `json:"mailboxTTL"`  // minutes
+}
+
+// IRCAddress returns the host:port of the IRC server.
+func (c *Config) IRCAddress() string {
+	host := c.IRCServer
+	if len(host) == 0 {
+		host = "irc.ppy.sh"
+	}
+
+	port := c.IRCPort
+	if port == 0 {
+		port = 6667
+		if c.IRCTLS {
+			port = 6697
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// BotNick returns the nick users send their IRC commands to.
+func (c *Config) BotNick() string {
+	if len(c.IRCNick) > 0 {
+		return c.IRCNick
+	}
+	return c.Username
 }
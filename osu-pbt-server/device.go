@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+)
+
+const pairingCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+const pairingCodeLength = 6
+
+// Device is a Sync installation bound to a osu! account.
+type Device struct {
+	ID           int64  `db:"id"`
+	UID          int64  `db:"uid"`
+	Name         string `db:"name"`
+	SecretHash   string `db:"secret_hash"`
+	CreatedDate  int64  `db:"created_date"`
+	LastUsedDate int64  `db:"last_used_date"`
+}
+
+func newDeviceSecret() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func hashDeviceSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newPairingCode() string {
+	code := make([]byte, pairingCodeLength)
+	max := big.NewInt(int64(len(pairingCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			log.Fatal(err)
+		}
+		code[i] = pairingCodeAlphabet[n.Int64()]
+	}
+	return string(code)
+}
+
+// Paired reports whether the client proved it belongs to the osu! account.
+// IRC traffic is only forwarded for paired clients.
+func (c *Client) Paired() bool {
+	return c.device != nil
+}
+
+// startPairing gives the client a one-time code, the user has to PM it to the bot.
+func (c *Client) startPairing() {
+	c.pairingCode = newPairingCode()
+	log.Infof("[Pairing] %s: waiting for code %s", c.user.Username, c.pairingCode)
+
+	if c.protocol == PROTOCOL_V2 {
+		c.sendEnvelope(ENVELOPE_PAIRING, 0, PairingData{Code: c.pairingCode})
+	}
+	c.SendNoticeToWS(fmt.Sprintf(`This Sync is not paired with your osu! account. Send "!pair %s" to %s in osu! to pair it.`, c.pairingCode, config.BotNick()))
+}
+
+// pair binds the client to a new device of the user and sends the device secret to Sync.
+// The binary protocol can't store the secret, so those clients are paired until they disconnect
+// and no device is saved.
+func (c *Client) pair(name string) bool {
+	if c.protocol != PROTOCOL_V2 {
+		c.pairingCode = ""
+		c.device = &Device{
+			UID:          c.user.UID,
+			Name:         name,
+			CreatedDate:  now(),
+			LastUsedDate: now(),
+		}
+		log.Infof("[Pairing] %s: paired until disconnect", c.user.Username)
+
+		c.SendNoticeToWS("This Sync is paired until it disconnects. Update the plugin to remember the pairing.")
+		c.deliverMails()
+		return true
+	}
+
+	secret := newDeviceSecret()
+	device, ok := userManager.AddDevice(c.user.UID, name, hashDeviceSecret(secret))
+	if !ok {
+		return false
+	}
+
+	c.pairingCode = ""
+	c.device = device
+	log.Infof("[Pairing] %s: paired device %d", c.user.Username, device.ID)
+
+	c.sendEnvelope(ENVELOPE_DEVICE, 0, DeviceData{
+		ID:     device.ID,
+		Name:   device.Name,
+		Secret: secret,
+	})
+	c.SendNoticeToWS("This Sync is paired with your osu! account.")
+
+	c.deliverMails()
+	return true
+}
+
+// printDevices writes one line per device of the user, lines are ended with eol.
+func printDevices(o io.Writer, uid int64, eol string) {
+	devices := userManager.GetDevices(uid)
+	if len(devices) == 0 {
+		fmt.Fprintf(o, "No device is paired.%s", eol)
+		return
+	}
+
+	for _, d := range devices {
+		lastUsed := time.Unix(0, d.LastUsedDate*int64(time.Millisecond)).Format("2006-01-02 15:04")
+		fmt.Fprintf(o, "#%d %s (last used %s)%s", d.ID, d.Name, lastUsed, eol)
+	}
+}
+
+// revokeDevice removes a device of the user and kicks the client using it.
+func revokeDevice(uid int64, username string, id int64, reason string) bool {
+	if !userManager.RemoveDevice(uid, id) {
+		return false
+	}
+
+	sessionManager.RemoveDevice(id)
+	userBukkit.KickDevice(username, id, reason)
+	log.Infof("[Device] %s: revoked device %d", username, id)
+	return true
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	mapset "github.com/deckarep/golang-set"
+)
+
+const fakeBanchoHost = "fake.bancho"
+
+// fakeBanchoBadPassword is rejected with 464, set it as ircBotPassword to test a failed login.
+const fakeBanchoBadPassword = "bad"
+
+// FakeBancho is a minimal in-process IRC server for -dev mode.
+// It speaks the subset IRCManager relies on: 001, NAMES, JOIN, PART, QUIT, KICK, NICK and PRIVMSG,
+// a PRIVMSG to a user not in #osu is answered with 401.
+type FakeBancho struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]string // connection -> nick
+	users mapset.Set          // simulated users in #osu
+}
+
+// StartFakeBancho listens on addr, "127.0.0.1:0" picks a free port.
+func StartFakeBancho(addr string) (*FakeBancho, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	fb := &FakeBancho{
+		listener: listener,
+		conns:    make(map[net.Conn]string),
+		users:    mapset.NewSet(),
+	}
+	go fb.accept()
+
+	log.Infof("[Fake Bancho] Listening %s", listener.Addr())
+	return fb, nil
+}
+
+// Addr returns the host and port the server listens on.
+func (fb *FakeBancho) Addr() (string, int32) {
+	addr := fb.listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), int32(addr.Port)
+}
+
+func (fb *FakeBancho) accept() {
+	for {
+		conn, err := fb.listener.Accept()
+		if err != nil {
+			log.Errorf("[Fake Bancho] %s", err)
+			return
+		}
+		go fb.serve(conn)
+	}
+}
+
+func (fb *FakeBancho) send(conn net.Conn, format string, a ...interface{}) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fmt.Fprintf(conn, format+"\r\n", a...)
+}
+
+// broadcast sends a line to every connected client.
+func (fb *FakeBancho) broadcast(format string, a ...interface{}) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	for conn := range fb.conns {
+		fmt.Fprintf(conn, format+"\r\n", a...)
+	}
+}
+
+func (fb *FakeBancho) nick(conn net.Conn) string {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.conns[conn]
+}
+
+func (fb *FakeBancho) nickInUse(nick string) bool {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	for _, n := range fb.conns {
+		if strings.EqualFold(n, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fb *FakeBancho) names(nicks ...string) string {
+	names := nicks
+	for _, user := range fb.users.ToSlice() {
+		names = append(names, user.(string))
+	}
+	return strings.Join(names, " ")
+}
+
+func (fb *FakeBancho) serve(conn net.Conn) {
+	defer func() {
+		fb.mu.Lock()
+		delete(fb.conns, conn)
+		fb.mu.Unlock()
+		conn.Close()
+	}()
+
+	fb.mu.Lock()
+	fb.conns[conn] = ""
+	fb.mu.Unlock()
+
+	pass := ""
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		cmd, args, trailing := parseFakeBanchoLine(line)
+
+		switch cmd {
+		case "PASS":
+			if len(args) > 0 {
+				pass = args[0]
+			}
+
+		case "NICK":
+			if len(args) == 0 {
+				break
+			}
+			if fb.nickInUse(args[0]) {
+				fb.send(conn, ":%s 433 * %s :Nickname is already in use", fakeBanchoHost, args[0])
+				break
+			}
+			fb.mu.Lock()
+			fb.conns[conn] = args[0]
+			fb.mu.Unlock()
+
+		case "USER":
+			nick := fb.nick(conn)
+			if pass == fakeBanchoBadPassword {
+				fb.send(conn, ":%s 464 %s :Bad authentication token.", fakeBanchoHost, nick)
+				return
+			}
+			fb.send(conn, ":%s 001 %s :Welcome to the fake Bancho", fakeBanchoHost, nick)
+
+		case "JOIN":
+			nick := fb.nick(conn)
+			fb.send(conn, ":%s!%s@%s JOIN :#osu", nick, nick, fakeBanchoHost)
+			fb.sendNames(conn, nick)
+
+		case "NAMES":
+			fb.sendNames(conn, fb.nick(conn))
+
+		case "PRIVMSG":
+			if len(args) == 0 {
+				break
+			}
+			if !fb.users.Contains(args[0]) {
+				fb.send(conn, ":%s 401 %s %s :No such nick/channel", fakeBanchoHost, fb.nick(conn), args[0])
+				break
+			}
+			log.Infof("[Fake Bancho] %s -> %s: %s", fb.nick(conn), args[0], trailing)
+
+		case "PING":
+			fb.send(conn, ":%s PONG %s :%s", fakeBanchoHost, fakeBanchoHost, trailing)
+
+		case "QUIT":
+			return
+		}
+	}
+}
+
+func (fb *FakeBancho) sendNames(conn net.Conn, nick string) {
+	fb.send(conn, ":%s 353 %s = #osu :%s", fakeBanchoHost, nick, fb.names(nick))
+	fb.send(conn, ":%s 366 %s #osu :End of /NAMES list.", fakeBanchoHost, nick)
+}
+
+// Join simulates a user joining #osu.
+func (fb *FakeBancho) Join(user string) {
+	fb.users.Add(user)
+	fb.broadcast(":%s!%s@%s JOIN :#osu", user, user, fakeBanchoHost)
+}
+
+// Quit simulates a user leaving Bancho.
+func (fb *FakeBancho) Quit(user string) {
+	fb.users.Remove(user)
+	fb.broadcast(":%s!%s@%s QUIT :quit", user, user, fakeBanchoHost)
+}
+
+// Part simulates a user leaving #osu.
+func (fb *FakeBancho) Part(user string) {
+	fb.users.Remove(user)
+	fb.broadcast(":%s!%s@%s PART :#osu", user, user, fakeBanchoHost)
+}
+
+// Kick simulates a user being kicked from #osu.
+func (fb *FakeBancho) Kick(user string) {
+	fb.users.Remove(user)
+	fb.broadcast(":%s KICK #osu %s :kicked", fakeBanchoHost, user)
+}
+
+// Nick simulates a user changing the nick.
+func (fb *FakeBancho) Nick(user string, nick string) {
+	fb.users.Remove(user)
+	fb.users.Add(nick)
+	fb.broadcast(":%s!%s@%s NICK :%s", user, user, fakeBanchoHost, nick)
+}
+
+// Privmsg simulates a user sending a private message to the bot.
+func (fb *FakeBancho) Privmsg(user string, msg string) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	for conn, nick := range fb.conns {
+		fmt.Fprintf(conn, ":%s!%s@%s PRIVMSG %s :%s\r\n", user, user, fakeBanchoHost, nick, msg)
+	}
+}
+
+// Drop closes the connections of the bot, to simulate an outage of Bancho.
+func (fb *FakeBancho) Drop() {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	for conn := range fb.conns {
+		conn.Close()
+	}
+}
+
+// parseFakeBanchoLine splits a client line into command, middle arguments and trailing argument.
+func parseFakeBanchoLine(line string) (string, []string, string) {
+	trailing := ""
+	if i := strings.Index(line, " :"); i >= 0 {
+		trailing = line[i+2:]
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, trailing
+	}
+	return strings.ToUpper(fields[0]), fields[1:], trailing
+}
+
+func initDevCommand(cm *CommandManager, fb *FakeBancho) {
+	cm.AddCommand("dev_join <nick:user>", "Simulate a user joining #osu", func(from string, args CommandArgs, o io.Writer) {
+		fb.Join(args.String("nick"))
+	})
+
+	cm.AddCommand("dev_quit <nick:user>", "Simulate a user leaving Bancho", func(from string, args CommandArgs, o io.Writer) {
+		fb.Quit(args.String("nick"))
+	})
+
+	cm.AddCommand("dev_part <nick:user>", "Simulate a user leaving #osu", func(from string, args CommandArgs, o io.Writer) {
+		fb.Part(args.String("nick"))
+	})
+
+	cm.AddCommand("dev_kick <nick:user>", "Simulate a user kicked from #osu", func(from string, args CommandArgs, o io.Writer) {
+		fb.Kick(args.String("nick"))
+	})
+
+	cm.AddCommand("dev_nick <nick:user> <new_nick:user>", "Simulate a nick change", func(from string, args CommandArgs, o io.Writer) {
+		fb.Nick(args.String("nick"), args.String("new_nick"))
+	})
+
+	cm.AddCommand("dev_pm <nick:user> <msg...>", "Simulate a user PMing the bot", func(from string, args CommandArgs, o io.Writer) {
+		fb.Privmsg(args.String("nick"), args.String("msg"))
+	})
+
+	cm.AddCommand("dev_drop", "Drop the connection of the bot", func(from string, args CommandArgs, o io.Writer) {
+		fb.Drop()
+	})
+
+	cm.AddCommand("dev_users", "Users in the fake #osu", func(from string, args CommandArgs, o io.Writer) {
+		fmt.Fprintf(o, "%s\r\n\033[32mCount: %d\033[37m\n\n\r", fb.names(), fb.users.Cardinality())
+	})
+}
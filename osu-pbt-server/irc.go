@@ -1,69 +1,502 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"strings"
+	"sync"
+	"time"
 
-	mapset "github.com/deckarep/golang-set"
-	irc "github.com/thoj/go-ircevent"
+	ircevent "github.com/thoj/go-ircevent"
 )
 
+// IRC connection states
+const (
+	IRC_DISCONNECTED int32 = iota
+	IRC_CONNECTING
+	IRC_REGISTERED
+	IRC_JOINED
+	IRC_AUTH_FAILED // Bancho rejected the bot, not retried
+)
+
+var ircStateNames = map[int32]string{
+	IRC_DISCONNECTED: "disconnected",
+	IRC_CONNECTING:   "connecting",
+	IRC_REGISTERED:   "registered",
+	IRC_JOINED:       "joined",
+	IRC_AUTH_FAILED:  "auth failed",
+}
+
+// Replies of Bancho that mean the bot can't log in, retrying won't help.
+var ircAuthFailures = map[string]string{
+	"464": "ircBotPassword was rejected, get the IRC password of the bot account from https://osu.ppy.sh/p/irc", // ERR_PASSWDMISMATCH
+	"465": "the bot account is banned from Bancho",                                                              // ERR_YOUREBANNEDCREEP
+	"432": "Bancho rejected the nick %s, it must be the name of the bot account",                                // ERR_ERRONEUSNICKNAME
+	"433": "the nick %s is in use, is another instance of the server running?",                                  // ERR_NICKNAMEINUSE
+	"436": "the nick %s is in use, is another instance of the server running?",                                  // ERR_NICKCOLLISION
+}
+
+// Reasons of the IRC error replies to a PRIVMSG of the bot.
+var ircErrorReasons = map[string]string{
+	"401": "isn't online on Bancho",   // ERR_NOSUCHNICK
+	"404": "can't receive messages",   // ERR_CANNOTSENDTOCHAN
+	"407": "matches too many targets", // ERR_TOOMANYTARGETS
+}
+
+const (
+	ircMinBackoff = 5 * time.Second
+	ircMaxBackoff = 5 * time.Minute
+	// a send stuck on a lost connection is given up after this
+	ircSendDrainTimeout = 5 * time.Second
+	// error replies come within seconds, older sent messages are forgotten
+	ircLastSentTTL = time.Minute
+)
+
+type sentMessage struct {
+	text string
+	at   time.Time
+}
+
 // IRCManager is a irc manager
 type IRCManager struct {
-	irc   *irc.Connection
-	users mapset.Set
+	presence  *PresenceTracker
+	scheduler *IRCScheduler
+	cm        *CommandManager
+	tlsConfig *tls.Config // nil without TLS
+
+	lastSentMu sync.Mutex
+	lastSent   map[string]sentMessage // last outbound message by normalizeNick, for error replies
+
+	mu         sync.Mutex
+	conn       *ircevent.Connection // nil while disconnected, a new one is made for every attempt
+	sends      *sync.WaitGroup      // sends in progress on conn
+	state      int32
+	stateSince time.Time
+	reconnects int
+	wasJoined  bool // the bridge was up before the last disconnect
+
+	authenticated bool   // the bot logged in to Bancho at least once
+	authError     string // why Bancho rejected the bot
+}
+
+// State returns the connection state and when it was entered.
+func (irc *IRCManager) State() (int32, time.Time) {
+	irc.mu.Lock()
+	defer irc.mu.Unlock()
+	return irc.state, irc.stateSince
+}
+
+// Reconnects returns how many times the connection to Bancho was retried.
+func (irc *IRCManager) Reconnects() int {
+	irc.mu.Lock()
+	defer irc.mu.Unlock()
+	return irc.reconnects
+}
+
+// Authenticated reports whether the bot is logged in to Bancho, or why not.
+// A lost connection doesn't count once the bot logged in.
+func (irc *IRCManager) Authenticated() (bool, string) {
+	irc.mu.Lock()
+	defer irc.mu.Unlock()
+
+	if len(irc.authError) > 0 {
+		return false, irc.authError
+	}
+	if !irc.authenticated {
+		return false, "the bot hasn't logged in to Bancho yet"
+	}
+	return true, ""
+}
+
+// failAuth stops the connection, run won't reconnect.
+func (irc *IRCManager) failAuth(conn *ircevent.Connection, reason string) {
+	irc.mu.Lock()
+	irc.authError = reason
+	irc.mu.Unlock()
+
+	log.Errorf("[IRC] Can't log in: %s", reason)
+	select {
+	case conn.ErrorChan() <- fmt.Errorf("login failed: %s", reason):
+	default:
+	}
+}
+
+// Bridged reports whether the bot is in #osu and can relay messages.
+// It checks what sendRaw checks, a lost connection isn't bridged while it's torn down.
+func (irc *IRCManager) Bridged() bool {
+	irc.mu.Lock()
+	defer irc.mu.Unlock()
+
+	return irc.conn != nil && irc.state == IRC_JOINED
+}
+
+func (irc *IRCManager) setState(state int32) {
+	irc.mu.Lock()
+	old := irc.state
+	irc.state = state
+	irc.stateSince = time.Now()
+	if state == IRC_JOINED {
+		irc.wasJoined = true
+	}
+	irc.mu.Unlock()
+
+	if old == state {
+		return
+	}
+	if state == IRC_JOINED {
+		irc.scheduler.Wake()
+	}
+	log.Infof("[IRC] %s -> %s", ircStateNames[old], ircStateNames[state])
+
+	switch {
+	case state == IRC_JOINED:
+		userBukkit.NoticeAll("The bridge to Bancho is up, messages are relayed again.")
+	case state == IRC_DISCONNECTED && old >= IRC_REGISTERED:
+		userBukkit.NoticeAll("The bridge to Bancho is down, messages can't be relayed until it's back.")
+	case state == IRC_AUTH_FAILED:
+		userBukkit.NoticeAll("The bot can't log in to Bancho, messages can't be relayed.")
+	}
+}
+
+// run keeps the bot connected, reconnecting with exponential backoff and jitter.
+func (irc *IRCManager) run() {
+	backoff := ircMinBackoff
+
+	for {
+		irc.setState(IRC_CONNECTING)
+
+		//go-ircevent can't reuse a disconnected connection, every attempt gets a new one
+		conn := newIRCConnection(irc)
+		err := conn.Connect(config.IRCAddress())
+		if err == nil {
+			sends := &sync.WaitGroup{}
+			irc.mu.Lock()
+			irc.conn = conn
+			irc.sends = sends
+			irc.wasJoined = false
+			irc.mu.Unlock()
+
+			err = <-conn.ErrorChan()
+
+			irc.mu.Lock()
+			irc.conn = nil
+			if irc.wasJoined {
+				backoff = ircMinBackoff
+			}
+			irc.mu.Unlock()
+			irc.teardown(conn, sends)
+		}
+
+		irc.mu.Lock()
+		authError := irc.authError
+		irc.mu.Unlock()
+		if len(authError) > 0 {
+			irc.presence.Clear()
+			irc.setState(IRC_AUTH_FAILED)
+			log.Errorf("[IRC] Not reconnecting, fix the config and restart the server. (%s)", authError)
+			return
+		}
+
+		irc.presence.Clear()
+		irc.setState(IRC_DISCONNECTED)
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+		log.Warningf("[IRC] Disconnected (%s), reconnecting in %s", err, wait)
+		time.Sleep(wait)
+
+		irc.mu.Lock()
+		irc.reconnects++
+		irc.mu.Unlock()
+
+		backoff *= 2
+		if backoff > ircMaxBackoff {
+			backoff = ircMaxBackoff
+		}
+	}
+}
+
+// teardown stops the goroutines of a lost connection once the sends in progress returned.
+func (irc *IRCManager) teardown(conn *ircevent.Connection, sends *sync.WaitGroup) {
+	drained := make(chan struct{})
+	go func() {
+		sends.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(ircSendDrainTimeout):
+		log.Warningf("[IRC] A send is stuck on the lost connection, closing it anyway")
+	}
+	conn.Disconnect()
+}
+
+// sendRaw writes a line to Bancho, it returns false if the bot isn't in #osu.
+func (irc *IRCManager) sendRaw(line string) (sent bool) {
+	irc.mu.Lock()
+	conn, sends := irc.conn, irc.sends
+	if conn == nil || irc.state != IRC_JOINED {
+		irc.mu.Unlock()
+		return false
+	}
+	sends.Add(1)
+	irc.mu.Unlock()
+
+	defer func() {
+		//teardown gave up waiting and closed the connection under a stuck send
+		if r := recover(); r != nil {
+			log.Warningf("[IRC] Lost a line, the connection was closed while sending. (%v)", r)
+			sent = false
+		}
+		sends.Done()
+	}()
+	conn.SendRaw(line)
+	return true
 }
 
-// SendMessage send a message to osu.ppy.sh
-func (irc *IRCManager) SendMessage(name string, msg string) {
-	irc.irc.Privmsg(name, msg)
+// privmsg sends a message dequeued by the scheduler, it returns false if the bridge is down.
+func (irc *IRCManager) privmsg(name string, msg string) bool {
+	irc.lastSentMu.Lock()
+	irc.lastSent[normalizeNick(name)] = sentMessage{msg, time.Now()}
+	irc.lastSentMu.Unlock()
+
+	return irc.sendRaw(fmt.Sprintf("PRIVMSG %s :%s", name, msg))
+}
+
+// takeLastSent returns and forgets the last message sent to the nick.
+func (irc *IRCManager) takeLastSent(name string) (string, bool) {
+	irc.lastSentMu.Lock()
+	defer irc.lastSentMu.Unlock()
+
+	key := normalizeNick(name)
+	sent, ok := irc.lastSent[key]
+	delete(irc.lastSent, key)
+	if !ok || time.Since(sent.at) > ircLastSentTTL {
+		return "", false
+	}
+	return sent.text, true
+}
+
+// expireLastSent forgets the sent messages no error reply came for.
+func (irc *IRCManager) expireLastSent() {
+	irc.lastSentMu.Lock()
+	defer irc.lastSentMu.Unlock()
+
+	for key, sent := range irc.lastSent {
+		if time.Since(sent.at) > ircLastSentTTL {
+			delete(irc.lastSent, key)
+		}
+	}
+}
+
+// handleSendError tells the Sync clients of the target that a message of the bot wasn't delivered.
+func (irc *IRCManager) handleSendError(code string, target string) {
+	msg, ok := irc.takeLastSent(target)
+	if !ok {
+		return
+	}
+	log.Warningf("[IRC] %s %s, message lost: %s", target, ircErrorReasons[code], msg)
+
+	if code == "401" {
+		irc.presence.Leave(target)
+	}
+
+	for _, c := range userBukkit.GetClientsByNick(target) {
+		if c.Paired() {
+			c.SendNoticeToWS(fmt.Sprintf("Not delivered, %s %s: %s", target, ircErrorReasons[code], msg))
+		}
+	}
+}
+
+// SendMessage queues a message to osu.ppy.sh, long messages are split.
+func (irc *IRCManager) SendMessage(name string, msg string) bool {
+	return irc.scheduler.PushAll(name, splitIRCMessage(msg, ircMaxMessageBytes), PRIORITY_NORMAL)
+}
+
+// SendPriorityMessage queues a message ahead of the normal traffic.
+func (irc *IRCManager) SendPriorityMessage(name string, msg string) bool {
+	return irc.scheduler.PushAll(name, splitIRCMessage(msg, ircMaxMessageBytes), PRIORITY_HIGH)
+}
+
+// resyncNames asks for the #osu user list periodically, the reply is handled by 353 and 366.
+// Expired sent messages are swept at the same time.
+func (irc *IRCManager) resyncNames() {
+	ticker := time.NewTicker(presenceResyncInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		irc.sendRaw("NAMES #osu")
+		irc.expireLastSent()
+	}
+}
+
+// relayToSync delivers a message from IRC to the paired clients and the detached sessions of the user,
+// msg goes to the mailbox if nobody is there.
+func relayToSync(nick string, msg string, sendClient func(*Client), recordSession func(*Session)) {
+	delivered := false
+	for _, c := range userBukkit.GetClientsByNick(nick) {
+		if c.Paired() {
+			sendClient(c)
+			delivered = true
+		}
+	}
+	for _, s := range sessionManager.Detached(nick) {
+		recordSession(s)
+		delivered = true
+	}
+
+	if !delivered {
+		log.Infof("[WS(offline) <- IRC] %s: %s", nick, msg)
+		if config.MailboxSize > 0 && userManager.ExistByUsername(nick) {
+			userManager.PushMail(userManager.GetUIDByUsername(nick), msg)
+		}
+		return
+	}
+	log.Infof("[WS <- IRC] %s: %s", nick, msg)
+}
+
+// notifyPresence tells the paired clients of a user that the user joined or left #osu.
+func notifyPresence(nick string, online bool) {
+	for _, c := range userBukkit.GetClientsByNick(nick) {
+		if c.Paired() {
+			c.SendPresenceToWS(online)
+		}
+	}
 }
 
 // IsOnline check a user is online or not
 func (irc *IRCManager) IsOnline(name string) bool {
-	return irc.users.Contains(name)
+	return irc.presence.IsOnline(name)
 }
 
-// NewIrc create a IRC Client connected osu.ppy.sh
-func NewIrc(cm *CommandManager) *IRCManager {
-	irccon := irc.IRC(config.Username, config.Username)
+func newIRCTLSConfig() (*tls.Config, error) {
+	host, _, _ := net.SplitHostPort(config.IRCAddress())
+	tlsConfig := &tls.Config{ServerName: host}
+
+	if len(config.IRCCABundle) > 0 {
+		pem, err := ioutil.ReadFile(config.IRCCABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", config.IRCCABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// newIRCConnection creates a connection to config.IRCAddress() with the callbacks of the manager.
+func newIRCConnection(ircManager *IRCManager) *ircevent.Connection {
+	cm := ircManager.cm
+	irccon := ircevent.IRC(config.BotNick(), config.Username)
+	if irccon == nil {
+		log.Fatal("[IRC] ircBotName can't be empty")
+	}
 	//irccon.VerboseCallbackHandler = true
 	//irccon.Debug = true
 	irccon.Password = config.Password
 
-	ircManager := &IRCManager{
-		irc:   irccon,
-		users: mapset.NewSet(),
+	if ircManager.tlsConfig != nil {
+		irccon.UseTLS = true
+		irccon.TLSConfig = ircManager.tlsConfig
+	}
+
+	//the nick of a bancho bot can't be changed, don't retry with "nick_"
+	irccon.ClearCallback("433")
+	irccon.ClearCallback("437")
+	for code, reason := range ircAuthFailures {
+		if strings.Contains(reason, "%s") {
+			reason = fmt.Sprintf(reason, config.BotNick())
+		}
+		reason := reason
+		irccon.AddCallback(code, func(e *ircevent.Event) {
+			ircManager.failAuth(irccon, reason)
+		})
+	}
+
+	irccon.AddCallback("NOTICE", func(e *ircevent.Event) {
+		if ok, _ := ircManager.Authenticated(); !ok && strings.Contains(strings.ToLower(e.Message()), "bad authentication token") {
+			ircManager.failAuth(irccon, ircAuthFailures["464"])
+		}
+	})
+
+	for code := range ircErrorReasons {
+		code := code
+		irccon.AddCallback(code, func(e *ircevent.Event) {
+			if len(e.Arguments) > 1 {
+				ircManager.handleSendError(code, e.Arguments[1])
+			}
+		})
 	}
 
-	irccon.AddCallback("001", func(e *irc.Event) {
+	irccon.AddCallback("001", func(e *ircevent.Event) {
 		log.Infof("[IRC] %s", e.Message())
-		ircManager.users.Clear()
+		ircManager.mu.Lock()
+		ircManager.authenticated = true
+		ircManager.mu.Unlock()
+		ircManager.setState(IRC_REGISTERED)
+		ircManager.presence.Clear()
 		log.Info("[IRC] Join the #osu channel")
 		irccon.Join("#osu")
 	})
 
 	//user list handle
-	irccon.AddCallback("353", func(e *irc.Event) {
-		nicks := strings.Split(e.Arguments[3], " ")
-		for _, nick := range nicks {
-			ircManager.users.Add(nick)
+	irccon.AddCallback("353", func(e *ircevent.Event) {
+		if len(e.Arguments) < 4 || !strings.EqualFold(e.Arguments[2], "#osu") {
+			return
 		}
+		ircManager.presence.Names(strings.Split(e.Arguments[3], " "))
 	})
 
-	irccon.AddCallback("QUIT", func(e *irc.Event) {
-		ircManager.users.Remove(e.Nick)
+	irccon.AddCallback("366", func(e *ircevent.Event) {
+		if len(e.Arguments) < 2 || !strings.EqualFold(e.Arguments[1], "#osu") {
+			return
+		}
+		ircManager.presence.EndNames()
 	})
 
-	irccon.AddCallback("JOIN", func(e *irc.Event) {
-		ircManager.users.Add(e.Nick)
+	irccon.AddCallback("QUIT", func(e *ircevent.Event) {
+		ircManager.presence.Leave(e.Nick)
+	})
+
+	irccon.AddCallback("PART", func(e *ircevent.Event) {
+		if strings.EqualFold(e.Arguments[0], "#osu") {
+			ircManager.presence.Leave(e.Nick)
+		}
+	})
+
+	irccon.AddCallback("KICK", func(e *ircevent.Event) {
+		if len(e.Arguments) > 1 && strings.EqualFold(e.Arguments[0], "#osu") {
+			ircManager.presence.Leave(e.Arguments[1])
+		}
+	})
+
+	irccon.AddCallback("NICK", func(e *ircevent.Event) {
+		ircManager.presence.Rename(e.Nick, e.Message())
+	})
+
+	irccon.AddCallback("JOIN", func(e *ircevent.Event) {
+		if e.Nick == irccon.GetNick() {
+			ircManager.setState(IRC_JOINED)
+			return
+		}
+		ircManager.presence.Join(e.Nick)
 	})
 
 	//handle message
-	irccon.AddCallback("PRIVMSG", func(e *irc.Event) {
-		if e.Nick == config.Username {
+	irccon.AddCallback("PRIVMSG", func(e *ircevent.Event) {
+		if e.Nick == irccon.GetNick() {
 			return
 		}
 
+		ircManager.presence.Seen(e.Nick)
+
 		channel := e.Arguments[0]
 		if channel == "#osu" {
 			return
@@ -77,26 +510,56 @@ func NewIrc(cm *CommandManager) *IRCManager {
 			log.Infof("[IRC Command] %s: %s", e.Nick, msg)
 			cm.PushCommandEx(e.Nick, trimedMsg, IRCWirter{
 				name: e.Nick,
-				irc:  irccon,
+				irc:  ircManager,
 			})
 			return
 		}
 
-		c, ok := userBukkit.GetClient(e.Nick)
-		if !ok {
-			log.Infof("[WS(offline) <- IRC] %s: %s", e.Nick, msg)
+		//is /np
+		if np, ok := parseNowPlaying(msg); ok {
+			nick := e.Nick
+			go func() {
+				np.enrich()
+				relayToSync(nick, np.Text, func(c *Client) {
+					c.SendNowPlayingToWS(np)
+				}, func(s *Session) {
+					s.RecordNowPlaying(np)
+				})
+			}()
 			return
 		}
-		log.Infof("[WS <- IRC] %s: %s", e.Nick, msg)
-		c.SendMessageToWS(e.Message())
+
+		relayToSync(e.Nick, msg, func(c *Client) {
+			c.SendMessageToWS(msg)
+		}, func(s *Session) {
+			s.RecordChat(msg)
+		})
 	})
 
-	err := irccon.Connect("irc.ppy.sh:6667")
-	if err != nil {
-		log.Fatal(err)
+	return irccon
+}
+
+// NewIrc create a IRC manager connected to config.IRCAddress()
+func NewIrc(cm *CommandManager) *IRCManager {
+	ircManager := &IRCManager{
+		presence:   NewPresenceTracker(notifyPresence),
+		cm:         cm,
+		stateSince: time.Now(),
+		lastSent:   make(map[string]sentMessage),
+	}
+
+	if config.IRCTLS {
+		tlsConfig, err := newIRCTLSConfig()
+		if err != nil {
+			log.Fatalf("[IRC] Can't load ircCABundle. (%s)", err)
+		}
+		ircManager.tlsConfig = tlsConfig
 	}
+	ircManager.scheduler = NewIRCScheduler(ircManager.privmsg, ircManager.Bridged)
 
-	go irccon.Loop()
+	go ircManager.run()
+	go ircManager.resyncNames()
+	go ircManager.scheduler.Run()
 
 	return ircManager
 }
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Priorities of outbound IRC messages, lower is sent first.
+const (
+	PRIORITY_HIGH   = iota // admin output and RTPPD results
+	PRIORITY_NORMAL        // chat and command replies
+	priorityCount
+)
+
+const (
+	defaultIRCSendRate  = 60 // messages per minute
+	defaultIRCSendBurst = 10
+	ircMaxQueuedPerUser = 64
+)
+
+type ircOutMessage struct {
+	target   string
+	text     string
+	priority int
+	queuedAt time.Time
+}
+
+// ircQueue holds the pending messages of one priority,
+// targets take turns so a busy user can't starve the others.
+type ircQueue struct {
+	pending map[string][]*ircOutMessage
+	order   []string // round-robin order of the targets with pending messages
+}
+
+// room returns the number of messages the target can still queue.
+func (q *ircQueue) room(target string) int {
+	return ircMaxQueuedPerUser - len(q.pending[target])
+}
+
+func (q *ircQueue) push(msg *ircOutMessage) bool {
+	msgs := q.pending[msg.target]
+	if len(msgs) >= ircMaxQueuedPerUser {
+		return false
+	}
+	if len(msgs) == 0 {
+		q.order = append(q.order, msg.target)
+	}
+	q.pending[msg.target] = append(msgs, msg)
+	return true
+}
+
+// unshift puts back a message that couldn't be sent, it goes out first.
+func (q *ircQueue) unshift(msg *ircOutMessage) {
+	order := []string{msg.target}
+	for _, target := range q.order {
+		if target != msg.target {
+			order = append(order, target)
+		}
+	}
+	q.order = order
+	q.pending[msg.target] = append([]*ircOutMessage{msg}, q.pending[msg.target]...)
+}
+
+func (q *ircQueue) pop() (*ircOutMessage, bool) {
+	if len(q.order) == 0 {
+		return nil, false
+	}
+
+	target := q.order[0]
+	q.order = q.order[1:]
+	msgs := q.pending[target]
+	msg := msgs[0]
+	if len(msgs) > 1 {
+		q.pending[target] = msgs[1:]
+		q.order = append(q.order, target)
+	} else {
+		delete(q.pending, target)
+	}
+	return msg, true
+}
+
+func (q *ircQueue) len() int {
+	n := 0
+	for _, msgs := range q.pending {
+		n += len(msgs)
+	}
+	return n
+}
+
+// IRCSchedulerStats is a snapshot of the outbound IRC queue.
+type IRCSchedulerStats struct {
+	Queued   [priorityCount]int
+	Targets  int           // users with pending messages
+	Oldest   time.Duration // wait of the oldest pending message
+	Sent     int64
+	Dropped  int64
+	AvgWait  time.Duration
+	MaxWait  time.Duration
+	Tokens   float64
+	Rate     int32 // messages per minute
+	Capacity int32
+}
+
+// IRCScheduler sends all outbound IRC messages of the bot,
+// limited by a global token bucket of config.IRCSendRate messages per minute.
+// Messages are held while the bridge is down.
+type IRCScheduler struct {
+	send  func(target string, text string) bool // false if the message wasn't sent
+	ready func() bool                           // whether messages can be sent now
+
+	mu       sync.Mutex
+	queues   [priorityCount]*ircQueue
+	notify   chan struct{}
+	tokens   float64
+	refillAt time.Time
+
+	sent      int64
+	dropped   int64
+	totalWait time.Duration
+	maxWait   time.Duration
+}
+
+func (s *IRCScheduler) limits() (int32, int32) {
+	rate := config.IRCSendRate
+	if rate <= 0 {
+		rate = defaultIRCSendRate
+	}
+	burst := config.IRCSendBurst
+	if burst <= 0 {
+		burst = defaultIRCSendBurst
+	}
+	return rate, burst
+}
+
+// refill adds the tokens earned since the last refill, s.mu must be held.
+func (s *IRCScheduler) refill() {
+	rate, burst := s.limits()
+	now := time.Now()
+	s.tokens += now.Sub(s.refillAt).Minutes() * float64(rate)
+	if s.tokens > float64(burst) {
+		s.tokens = float64(burst)
+	}
+	s.refillAt = now
+}
+
+// Push queues a message, it returns false if the target has too many pending messages.
+func (s *IRCScheduler) Push(target string, text string, priority int) bool {
+	return s.PushAll(target, []string{text}, priority)
+}
+
+// PushAll queues the parts of a message, either all of them or none
+// if the target doesn't have room for them.
+func (s *IRCScheduler) PushAll(target string, texts []string, priority int) bool {
+	s.mu.Lock()
+	q := s.queues[priority]
+	ok := q.room(target) >= len(texts)
+	if ok {
+		now := time.Now()
+		for _, text := range texts {
+			q.push(&ircOutMessage{
+				target:   target,
+				text:     text,
+				priority: priority,
+				queuedAt: now,
+			})
+		}
+	} else {
+		s.dropped += int64(len(texts))
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		log.Warningf("[IRC] Outbound queue of %s is full, message dropped", target)
+		return false
+	}
+
+	s.Wake()
+	return true
+}
+
+// Wake lets a waiting scheduler check the queues and the bridge again.
+func (s *IRCScheduler) Wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take waits for the bridge and a token, then pops the most urgent message.
+func (s *IRCScheduler) take() *ircOutMessage {
+	for {
+		s.mu.Lock()
+		s.refill()
+
+		empty := true
+		for _, q := range s.queues {
+			if len(q.order) > 0 {
+				empty = false
+			}
+		}
+
+		if empty || !s.ready() {
+			s.mu.Unlock()
+			<-s.notify
+			continue
+		}
+
+		if s.tokens < 1 {
+			rate, _ := s.limits()
+			wait := time.Duration((1 - s.tokens) / float64(rate) * float64(time.Minute))
+			s.mu.Unlock()
+			time.Sleep(wait)
+			continue
+		}
+
+		s.tokens--
+		for _, q := range s.queues {
+			if msg, ok := q.pop(); ok {
+				s.mu.Unlock()
+				return msg
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// done records a sent message, or puts it back and refunds the token if the bridge went down.
+func (s *IRCScheduler) done(msg *ircOutMessage, sent bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !sent {
+		s.tokens++
+		s.queues[msg.priority].unshift(msg)
+		return
+	}
+
+	wait := time.Since(msg.queuedAt)
+	s.sent++
+	s.totalWait += wait
+	if wait > s.maxWait {
+		s.maxWait = wait
+	}
+}
+
+func (s *IRCScheduler) Run() {
+	for {
+		msg := s.take()
+		s.done(msg, s.send(msg.target, msg.text))
+	}
+}
+
+// Stats returns the queue depth and wait times.
+func (s *IRCScheduler) Stats() IRCSchedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refill()
+	rate, burst := s.limits()
+	stats := IRCSchedulerStats{
+		Sent:     s.sent,
+		Dropped:  s.dropped,
+		MaxWait:  s.maxWait,
+		Tokens:   s.tokens,
+		Rate:     rate,
+		Capacity: burst,
+	}
+	if s.sent > 0 {
+		stats.AvgWait = s.totalWait / time.Duration(s.sent)
+	}
+
+	targets := make(map[string]bool)
+	for i, q := range s.queues {
+		stats.Queued[i] = q.len()
+		for target, msgs := range q.pending {
+			targets[target] = true
+			if wait := time.Since(msgs[0].queuedAt); wait > stats.Oldest {
+				stats.Oldest = wait
+			}
+		}
+	}
+	stats.Targets = len(targets)
+	return stats
+}
+
+func NewIRCScheduler(send func(target string, text string) bool, ready func() bool) *IRCScheduler {
+	s := &IRCScheduler{
+		send:     send,
+		ready:    ready,
+		notify:   make(chan struct{}, 1),
+		refillAt: time.Now(),
+	}
+	for i := range s.queues {
+		s.queues[i] = &ircQueue{pending: make(map[string][]*ircOutMessage)}
+	}
+	_, burst := s.limits()
+	s.tokens = float64(burst)
+	return s
+}
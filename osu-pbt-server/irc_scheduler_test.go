@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func popAll(q *ircQueue) []string {
+	texts := []string{}
+	for {
+		msg, ok := q.pop()
+		if !ok {
+			return texts
+		}
+		texts = append(texts, msg.text)
+	}
+}
+
+func TestIRCQueueRoundRobin(t *testing.T) {
+	q := &ircQueue{pending: make(map[string][]*ircOutMessage)}
+	for _, msg := range []struct{ target, text string }{
+		{"a", "a1"}, {"a", "a2"}, {"a", "a3"}, {"b", "b1"}, {"c", "c1"}, {"b", "b2"},
+	} {
+		q.push(&ircOutMessage{target: msg.target, text: msg.text})
+	}
+
+	if q.len() != 6 {
+		t.Errorf("len() = %d, want 6", q.len())
+	}
+	want := []string{"a1", "b1", "c1", "a2", "b2", "a3"}
+	if texts := popAll(q); !reflect.DeepEqual(texts, want) {
+		t.Errorf("pop order %q, want %q", texts, want)
+	}
+}
+
+func TestIRCQueueUnshift(t *testing.T) {
+	q := &ircQueue{pending: make(map[string][]*ircOutMessage)}
+	q.push(&ircOutMessage{target: "a", text: "a1"})
+	q.push(&ircOutMessage{target: "a", text: "a2"})
+	q.push(&ircOutMessage{target: "b", text: "b1"})
+
+	msg, _ := q.pop()
+	q.unshift(msg)
+	want := []string{"a1", "b1", "a2"}
+	if texts := popAll(q); !reflect.DeepEqual(texts, want) {
+		t.Errorf("pop order after unshift %q, want %q", texts, want)
+	}
+
+	q.push(&ircOutMessage{target: "c", text: "c1"})
+	q.unshift(&ircOutMessage{target: "d", text: "d1"})
+	want = []string{"d1", "c1"}
+	if texts := popAll(q); !reflect.DeepEqual(texts, want) {
+		t.Errorf("pop order after unshift of a new target %q, want %q", texts, want)
+	}
+}
+
+func TestIRCQueueLimit(t *testing.T) {
+	q := &ircQueue{pending: make(map[string][]*ircOutMessage)}
+	for i := 0; i < ircMaxQueuedPerUser; i++ {
+		if !q.push(&ircOutMessage{target: "a"}) {
+			t.Fatalf("push %d failed", i)
+		}
+	}
+	if q.push(&ircOutMessage{target: "a"}) {
+		t.Error("push over the limit succeeded")
+	}
+	if !q.push(&ircOutMessage{target: "b"}) {
+		t.Error("a full target blocks the others")
+	}
+}
+
+func TestIRCSchedulerPushAll(t *testing.T) {
+	s := NewIRCScheduler(nil, nil)
+	parts := make([]string, ircMaxQueuedPerUser-1)
+	if !s.PushAll("a", parts, PRIORITY_NORMAL) {
+		t.Fatal("PushAll of parts that fit failed")
+	}
+	if s.PushAll("a", []string{"x", "y"}, PRIORITY_NORMAL) {
+		t.Error("PushAll of parts that don't fit succeeded")
+	}
+	if stats := s.Stats(); stats.Queued[PRIORITY_NORMAL] != ircMaxQueuedPerUser-1 || stats.Dropped != 2 {
+		t.Errorf("stats %+v, want %d queued and 2 dropped", stats, ircMaxQueuedPerUser-1)
+	}
+	if !s.Push("a", "z", PRIORITY_NORMAL) {
+		t.Error("Push of the last part that fits failed")
+	}
+}
+
+func TestIRCSchedulerRefill(t *testing.T) {
+	defer func(rate, burst int32) {
+		config.IRCSendRate, config.IRCSendBurst = rate, burst
+	}(config.IRCSendRate, config.IRCSendBurst)
+
+	tests := []struct {
+		rate, burst int32
+		tokens      float64
+		elapsed     time.Duration
+		want        float64
+	}{
+		{60, 10, 0, 3 * time.Second, 3},
+		{60, 10, 0, 30 * time.Second, 10},
+		{60, 10, 9.5, time.Second, 10},
+		{120, 10, 2, time.Second, 4},
+		{0, 0, 0, 2 * time.Second, 2}, // defaults, 60 per minute
+		{0, 0, 5, time.Hour, defaultIRCSendBurst},
+	}
+
+	for _, test := range tests {
+		config.IRCSendRate, config.IRCSendBurst = test.rate, test.burst
+		s := NewIRCScheduler(nil, nil)
+		s.tokens = test.tokens
+		s.refillAt = time.Now().Add(-test.elapsed)
+		s.refill()
+
+		if math.Abs(s.tokens-test.want) > 0.05 {
+			t.Errorf("rate %d, burst %d: %.2f tokens after %s, want %.2f", test.rate, test.burst, s.tokens, test.elapsed, test.want)
+		}
+	}
+}
+
+func TestIRCSchedulerRun(t *testing.T) {
+	defer func(rate, burst int32) {
+		config.IRCSendRate, config.IRCSendBurst = rate, burst
+	}(config.IRCSendRate, config.IRCSendBurst)
+	config.IRCSendRate, config.IRCSendBurst = 6000, 100
+
+	var ready, failures int32
+	sent := make(chan string, 10)
+	s := NewIRCScheduler(func(target string, text string) bool {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			return false
+		}
+		sent <- text
+		return true
+	}, func() bool {
+		return atomic.LoadInt32(&ready) == 1
+	})
+	go s.Run()
+
+	s.Push("a", "normal", PRIORITY_NORMAL)
+	s.Push("b", "high", PRIORITY_HIGH)
+
+	select {
+	case text := <-sent:
+		t.Fatalf("%q was sent while the bridge is down", text)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the first send fails, the message is held and sent again
+	atomic.StoreInt32(&failures, 1)
+	atomic.StoreInt32(&ready, 1)
+	s.Wake()
+
+	for _, want := range []string{"high", "normal"} {
+		select {
+		case text := <-sent:
+			if text != want {
+				t.Errorf("sent %q, want %q", text, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q wasn't sent", want)
+		}
+	}
+
+	if stats := s.Stats(); stats.Sent != 2 || stats.Queued[PRIORITY_HIGH]+stats.Queued[PRIORITY_NORMAL] != 0 {
+		t.Errorf("stats %+v, want 2 sent and nothing queued", stats)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// ircMaxMessageBytes leaves room for the ":nick!user@host PRIVMSG target :" prefix
+// within the 512 bytes of an IRC line.
+const ircMaxMessageBytes = 400
+
+// Continuation markers of a split message.
+const (
+	ircContinuedSuffix = " ..."
+	ircContinuesPrefix = "... "
+)
+
+// splitIRCMessage splits text into parts of at most limit bytes,
+// cutting between words if possible and never inside a utf-8 sequence.
+func splitIRCMessage(text string, limit int) []string {
+	text = strings.TrimSpace(text)
+	parts := []string{}
+	prefix := ""
+
+	for len(prefix)+len(text) > limit {
+		budget := limit - len(prefix) - len(ircContinuedSuffix)
+
+		cut := budget
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		// prefer the last space, unless it leaves a very short part
+		if space := strings.LastIndexByte(text[:cut+1], ' '); space > budget/2 {
+			cut = space
+		}
+		if cut == 0 {
+			break
+		}
+
+		parts = append(parts, prefix+strings.TrimSpace(text[:cut])+ircContinuedSuffix)
+		text = strings.TrimSpace(text[cut:])
+		prefix = ircContinuesPrefix
+	}
+
+	if len(text) > 0 {
+		parts = append(parts, prefix+text)
+	}
+	return parts
+}
+
+// splitIRCLines splits multi-line output into IRC messages, empty lines are dropped.
+func splitIRCLines(text string) []string {
+	parts := []string{}
+	lines := strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == '\r' })
+	for _, line := range lines {
+		parts = append(parts, splitIRCMessage(line, ircMaxMessageBytes)...)
+	}
+	return parts
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitIRCMessage(t *testing.T) {
+	tests := []struct {
+		text  string
+		limit int
+		parts []string
+	}{
+		{"hello", 20, []string{"hello"}},
+		{"  hello  ", 20, []string{"hello"}},
+		{"", 20, []string{}},
+		{"   ", 20, []string{}},
+		{strings.Repeat("a", 20), 20, []string{strings.Repeat("a", 20)}},
+		{"aaaa bbbb cccc dddd eeee", 20, []string{"aaaa bbbb cccc ...", "... dddd eeee"}},
+		// the only space is too early, the word is cut instead
+		{"a bbbbbbbbbbbbbbbbbbbbbbbb", 20, []string{"a bbbbbbbbbbbbbb ...", "... bbbbbbbbbb"}},
+		{strings.Repeat("a", 30), 20, []string{strings.Repeat("a", 16) + " ...", "... " + strings.Repeat("a", 14)}},
+		// the 12 byte budget of the second part would end inside an é
+		{strings.Repeat("é", 10) + "x" + strings.Repeat("é", 10), 20, []string{strings.Repeat("é", 8) + " ...", "... ééxééé ...", "... " + strings.Repeat("é", 7)}},
+	}
+
+	for _, test := range tests {
+		parts := splitIRCMessage(test.text, test.limit)
+		if !reflect.DeepEqual(parts, test.parts) {
+			t.Errorf("splitIRCMessage(%q, %d) = %q, want %q", test.text, test.limit, parts, test.parts)
+		}
+	}
+}
+
+func TestSplitIRCMessageLimits(t *testing.T) {
+	texts := []string{
+		strings.Repeat("word ", 300),
+		strings.Repeat("x", 1000),
+		strings.Repeat("é", 500),
+		strings.Repeat("日本語 ", 100),
+		strings.Repeat("🎵", 200),
+	}
+
+	for _, text := range texts {
+		parts := splitIRCMessage(text, ircMaxMessageBytes)
+		if len(parts) < 2 {
+			t.Errorf("%d bytes weren't split: %d parts", len(text), len(parts))
+		}
+
+		var joined strings.Builder
+		for i, part := range parts {
+			if len(part) > ircMaxMessageBytes {
+				t.Errorf("part %d is %d bytes", i, len(part))
+			}
+			if !utf8.ValidString(part) {
+				t.Errorf("part %d isn't valid utf-8: %q", i, part)
+			}
+			if i > 0 && !strings.HasPrefix(part, ircContinuesPrefix) {
+				t.Errorf("part %d doesn't start with %q", i, ircContinuesPrefix)
+			}
+			if i < len(parts)-1 && !strings.HasSuffix(part, ircContinuedSuffix) {
+				t.Errorf("part %d doesn't end with %q", i, ircContinuedSuffix)
+			}
+			part = strings.TrimPrefix(part, ircContinuesPrefix)
+			part = strings.TrimSuffix(part, ircContinuedSuffix)
+			joined.WriteString(strings.Replace(part, " ", "", -1))
+		}
+
+		if want := strings.Replace(text, " ", "", -1); joined.String() != want {
+			t.Errorf("the parts of %d bytes don't add up to the text", len(text))
+		}
+	}
+}
+
+func TestSplitIRCLines(t *testing.T) {
+	parts := splitIRCLines("Usage:\n\rhelp\n\r\n\rversion  \n")
+	want := []string{"Usage:", "help", "version"}
+	if !reflect.DeepEqual(parts, want) {
+		t.Errorf("splitIRCLines = %q, want %q", parts, want)
+	}
+}
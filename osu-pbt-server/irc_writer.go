@@ -1,15 +1,13 @@
 package main
 
-import (
-	irc "github.com/thoj/go-ircevent"
-)
-
 type IRCWirter struct {
 	name string //irc nick
-	irc  *irc.Connection
+	irc  *IRCManager
 }
 
 func (iw IRCWirter) Write(p []byte) (n int, err error) {
-	iw.irc.Privmsg(iw.name, string(p))
+	for _, line := range splitIRCLines(string(p)) {
+		iw.irc.SendMessage(iw.name, line)
+	}
 	return len(p), nil
 }
@@ -0,0 +1,21 @@
+package main
+
+import "fmt"
+
+// Mail is a IRC message received while the user's Sync was offline.
+type Mail struct {
+	ID      int64  `db:"id"`
+	UID     int64  `db:"uid"`
+	Message string `db:"message"`
+	Date    int64  `db:"date"`
+}
+
+// deliverMails sends the messages received while Sync was offline.
+func (c *Client) deliverMails() {
+	if mails := userManager.PopMails(c.user.UID); len(mails) > 0 {
+		c.SendNoticeToWS(fmt.Sprintf("You received %d messages while Sync was offline.", len(mails)))
+		for _, mail := range mails {
+			c.SendMessageToWS(mail.Message)
+		}
+	}
+}
@@ -1,14 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -21,11 +21,14 @@ var (
 	config     Config
 	osuAPI     *OsuAPI
 	ircManager *IRCManager
+	devMode    bool
 
-	userManager = NewUserManager() // database users
-	userBukkit  = NewBukkit()      // online users
+	userManager *UserManager  // database users, opened after the flags are parsed
+	userBukkit  = NewBukkit() // online users
 
-	tokenManager = NewTokenManager()
+	tokenManager     = NewTokenManager()
+	sessionManager   = NewSessionManager()
+	wsCommandManager = NewWSCommandManager()
 )
 
 var (
@@ -36,87 +39,462 @@ var (
 )
 
 func initStdinCommand(cm *CommandManager) {
-	cm.AddCallback("online", func(from string, args []string, o io.Writer) {
-		for _, v := range userBukkit.bukkit {
-			fmt.Fprintf(o, "%s\t", v.user.Username)
+	cm.AddCommand("online", "All online user", func(from string, args CommandArgs, o io.Writer) {
+		setCommandResult(o, adminOnlineData())
+		for _, name := range userBukkit.Usernames() {
+			ids := []string{}
+			for _, c := range userBukkit.GetClients(name) {
+				id := fmt.Sprintf("#%d", c.id)
+				if overflows, dropped := c.sendQueue.Overflows(); overflows > 0 {
+					id += fmt.Sprintf("[\033[33moverflows: %d, dropped: %d\033[37m]", overflows, dropped)
+				}
+				ids = append(ids, id)
+			}
+			fmt.Fprintf(o, "%s(%s)\t", name, strings.Join(ids, ","))
 		}
-		fmt.Fprintf(o, "\r\n\033[32mCount: %d\033[37m\n\n\r", len(userBukkit.bukkit))
-	}, "\t\t\tAll online user", 0)
+		users, clients := userBukkit.Count()
+		fmt.Fprintf(o, "\r\n\033[32mCount: %d (%d connections)\033[37m\n\n\r", users, clients)
+	})
 
-	cm.AddCallback("toirc", func(from string, args []string, o io.Writer) {
-		c, ok := userBukkit.GetClient(args[0])
-		if !ok {
-			fmt.Fprintf(o, "%s is offline.\n\r", args[0])
+	cm.AddCommand("toirc <username:user> <msg...>", "Send a Message to IRC", func(from string, args CommandArgs, o io.Writer) {
+		username := args.String("username")
+		if !userBukkit.IsOnline(username) {
+			failCommand(o, "%s is offline.\n\r", username)
+			return
+		}
+		parts := splitIRCMessage(args.String("msg"), ircMaxMessageBytes)
+		if !ircManager.SendPriorityMessage(username, args.String("msg")) {
+			failCommand(o, "The outbound IRC queue of %s is full.\n\r", username)
+			return
+		}
+		setCommandResult(o, AdminDeliveryResult{Username: username, Delivered: len(parts)})
+	})
+
+	cm.AddCommand("devices <username:user>", "List the devices of a user", func(from string, args CommandArgs, o io.Writer) {
+		username := args.String("username")
+		if !userManager.ExistByUsername(username) {
+			fmt.Fprintf(o, "User(%s) does not exist.\n\r", username)
+			return
+		}
+		printDevices(o, userManager.GetUIDByUsername(username), "\n\r")
+	})
+
+	cm.AddCommand("name_device <username:user> <id:int> <name...>", "Rename a device of a user", func(from string, args CommandArgs, o io.Writer) {
+		username := args.String("username")
+		if !userManager.ExistByUsername(username) {
+			fmt.Fprintf(o, "User(%s) does not exist.\n\r", username)
 			return
 		}
-		msg := strings.Join(args[1:], " ")
-		c.SendMessageToIRC(msg)
-	}, "[username] [msg]\tSend a Message to IRC", 2)
+		id := args.Int("id")
+		if !userManager.RenameDevice(userManager.GetUIDByUsername(username), id, args.String("name")) {
+			fmt.Fprintf(o, "Device(#%d) does not exist.\n\r", id)
+		}
+	})
+
+	cm.AddCommand("revoke <username:user> <id:int>", "Revoke a device of a user", func(from string, args CommandArgs, o io.Writer) {
+		username := args.String("username")
+		if !userManager.ExistByUsername(username) {
+			fmt.Fprintf(o, "User(%s) does not exist.\n\r", username)
+			return
+		}
+		id := args.Int("id")
+		if !revokeDevice(userManager.GetUIDByUsername(username), username, id, "The device is revoked by the administrator.") {
+			fmt.Fprintf(o, "Device(#%d) does not exist.\n\r", id)
+		}
+	})
 
-	cm.AddCallback("tosync", func(from string, args []string, o io.Writer) {
-		c, ok := userBukkit.GetClient(args[0])
+	cm.AddCommand("versions", "Online clients per plugin version", func(from string, args CommandArgs, o io.Writer) {
+		counts := make(map[string]int)
+		versions := []*version.Version{}
+		for _, name := range userBukkit.Usernames() {
+			for _, c := range userBukkit.GetClients(name) {
+				if counts[c.version.String()] == 0 {
+					versions = append(versions, c.version)
+				}
+				counts[c.version.String()]++
+			}
+		}
+		sort.Sort(version.Collection(versions))
+
+		for _, ver := range versions {
+			fmt.Fprintf(o, "%s\t%d", ver, counts[ver.String()])
+			if isDeprecatedPluginVersion(ver) {
+				fmt.Fprint(o, "\t(deprecated)")
+			}
+			fmt.Fprint(o, "\n\r")
+		}
+		fmt.Fprintf(o, "\033[32mVersions: %d\033[37m\n\n\r", len(versions))
+	})
+
+	cm.AddCommand("irc", "Show the IRC connection state", func(from string, args CommandArgs, o io.Writer) {
+		state, since := ircManager.State()
+		fmt.Fprintf(o, "State: %s (since %s)\n\r", ircStateNames[state], since.Format("2006-01-02 15:04:05"))
+		if ok, reason := ircManager.Authenticated(); !ok {
+			fmt.Fprintf(o, "Not logged in: %s\n\r", reason)
+		}
+		fmt.Fprintf(o, "Reconnects: %d\n\r", ircManager.Reconnects())
+		fmt.Fprintf(o, "Online IRC users: %d\n\r", ircManager.presence.Count())
+		if lastSync := ircManager.presence.LastSync(); !lastSync.IsZero() {
+			fmt.Fprintf(o, "Last NAMES resync: %s\n\r", lastSync.Format("2006-01-02 15:04:05"))
+		}
+		fmt.Fprintf(o, "\n\r")
+	})
+
+	cm.AddCommand("ircqueue", "Show the outbound IRC queue", func(from string, args CommandArgs, o io.Writer) {
+		stats := ircManager.scheduler.Stats()
+		fmt.Fprintf(o, "Queued: %d (high: %d, normal: %d) from %d users\n\r",
+			stats.Queued[PRIORITY_HIGH]+stats.Queued[PRIORITY_NORMAL], stats.Queued[PRIORITY_HIGH], stats.Queued[PRIORITY_NORMAL], stats.Targets)
+		fmt.Fprintf(o, "Oldest waiting: %s\n\r", stats.Oldest.Round(time.Millisecond))
+		fmt.Fprintf(o, "Sent: %d, dropped: %d\n\r", stats.Sent, stats.Dropped)
+		fmt.Fprintf(o, "Wait: avg %s, max %s\n\r", stats.AvgWait.Round(time.Millisecond), stats.MaxWait.Round(time.Millisecond))
+		fmt.Fprintf(o, "Tokens: %.1f/%d, %d messages per minute\n\n\r", stats.Tokens, stats.Capacity, stats.Rate)
+	})
+
+	cm.AddCommand("user info <username:user>", "Show a user", func(from string, args CommandArgs, o io.Writer) {
+		u, ok := userManager.GetUserByUsername(args.String("username"))
 		if !ok {
-			fmt.Fprintf(o, "%s is offline.\n\r", args[0])
+			fmt.Fprintf(o, "User(%s) does not exist.\n\r", args.String("username"))
 			return
 		}
-		msg := strings.Join(args[1:], " ")
+		printUser(o, u)
+	})
 
-		c.SendNoticeToWS(msg)
-	}, "[username] [msg]\tSend a Message to Sync", 2)
+	cm.AddCommand("user bans", "List the banned users", func(from string, args CommandArgs, o io.Writer) {
+		users := userManager.GetBannedUsers()
+		for _, u := range users {
+			fmt.Fprintf(o, "%s(%d)\t%s left\n\r", u.Username, u.UID, u.GetBannedETA().Round(time.Second))
+		}
+		fmt.Fprintf(o, "\033[32mBanned: %d\033[37m\n\n\r", len(users))
+	})
 
-	cm.AddCallback("kick", func(from string, args []string, o io.Writer) {
-		userBukkit.Kick(args[0], "You are taken offline by the administrator.")
-	}, "[username]\t\tLet a user go offline", 1)
+	cm.AddCommand("quit", "Quit server", func(from string, args CommandArgs, o io.Writer) {
+		cm.QuitStdinPump()
+		os.Exit(0)
+	})
+}
 
-	cm.AddCallback("ban", func(from string, args []string, o io.Writer) {
-		u, ok := userManager.GetUserByUsername(args[0])
+// initModerationCommand registers the commands moderators can run on IRC too.
+func initModerationCommand(cm *CommandManager) {
+	cm.AddCommandWithRole("tosync <username:user> <msg...>", "Send a Message to Sync", ROLE_MODERATOR, func(from string, args CommandArgs, o io.Writer) {
+		clients := userBukkit.GetClients(args.String("username"))
+		if len(clients) == 0 {
+			failCommand(o, "%s is offline.\n\r", args.String("username"))
+			return
+		}
+		msg := args.String("msg")
+
+		for _, c := range clients {
+			c.SendNoticeToWS(msg)
+		}
+		setCommandResult(o, AdminDeliveryResult{Username: args.String("username"), Delivered: len(clients)})
+	})
+
+	cm.AddCommandWithRole("kick <username:user> [id:int]", "Let a user or one connection go offline", ROLE_MODERATOR, func(from string, args CommandArgs, o io.Writer) {
+		const reason = "You are taken offline by the administrator."
+		username := args.String("username")
+		result := AdminKickResult{Username: username, Connections: []int64{}}
+		if !args.Has("id") {
+			for _, c := range userBukkit.GetClients(username) {
+				userBukkit.KickClient(c, reason)
+				result.Connections = append(result.Connections, c.id)
+			}
+			setCommandResult(o, result)
+			return
+		}
+
+		id := args.Int("id")
+		c, ok := userBukkit.GetClientByID(username, id)
 		if !ok {
-			fmt.Fprintf(o, "User(%s) does not exist.\n\r", args[0])
+			failCommand(o, "Connection(#%d) of %s does not exist.\n\r", id, username)
 			return
 		}
-		minutes, err := strconv.ParseInt(args[1], 10, 64)
-		if err != nil {
-			fmt.Fprintf(o, "minutes format is incorrect.\n\r")
+		userBukkit.KickClient(c, reason)
+		result.Connections = append(result.Connections, c.id)
+		setCommandResult(o, result)
+	})
+
+	cm.AddCommandWithRole("ban <username:user> <time:duration>", "Ban a user, time is like 30m, 2h, 1d or minutes", ROLE_MODERATOR, func(from string, args CommandArgs, o io.Writer) {
+		username := args.String("username")
+		u, ok := userManager.GetUserByUsername(username)
+		if !ok {
+			failCommand(o, "User(%s) does not exist.\n\r", username)
 			return
 		}
-		u.Ban(time.Duration(minutes) * time.Minute)
-		userBukkit.Kick(args[0], "You are ban by the administrator.")
+		u.Ban(args.Duration("time"))
+		userBukkit.Kick(username, "You are ban by the administrator.")
 		userManager.Update(u)
-	}, "[username] [minutes]\tBan a user", 2)
+		fmt.Fprintf(o, "%s is banned for %s.\n\r", username, args.Duration("time"))
+		setCommandResult(o, AdminBanResult{
+			Username: u.Username,
+			UID:      u.UID,
+			Banned:   true,
+			Until:    time.Now().Add(u.GetBannedETA()).UTC().Format(time.RFC3339),
+		})
+	})
 
-	cm.AddCallback("unban", func(from string, args []string, o io.Writer) {
-		u, ok := userManager.GetUserByUsername(args[0])
+	cm.AddCommandWithRole("unban <username:user>", "Unban a user", ROLE_MODERATOR, func(from string, args CommandArgs, o io.Writer) {
+		u, ok := userManager.GetUserByUsername(args.String("username"))
 		if !ok {
-			fmt.Fprintf(o, "User(%s) does not exist.\n\r", args[0])
+			failCommand(o, "User(%s) does not exist.\n\r", args.String("username"))
 			return
 		}
 		u.Unban()
 		userManager.Update(u)
-	}, "[username]\t\tUnban a user", 1)
+		fmt.Fprintf(o, "%s is unbanned.\n\r", u.Username)
+		setCommandResult(o, AdminBanResult{Username: u.Username, UID: u.UID})
+	})
 	
-	cm.AddCallback("quit", func(from string, args []string, o io.Writer) {
-		cm.QuitStdinPump()
-		os.Exit(0)
-	},"\t\t\tQuit server",0)
+
+	cm.AddCommandWithRole("role <username:user> [role]", "Show or set the role of a user: user, moderator or admin", ROLE_ADMIN, func(from string, args CommandArgs, o io.Writer) {
+		u, ok := getUser(args.String("username"))
+		if !ok {
+			fmt.Fprintf(o, "User(%s) does not exist.\n\r", args.String("username"))
+			return
+		}
+
+		if !args.Has("role") {
+			fmt.Fprintf(o, "%s is %s.\n\r", u.Username, roleNames[userManager.GetRole(u.UID)])
+			return
+		}
+
+		role, ok := parseRole(args.String("role"))
+		if !ok {
+			fmt.Fprintf(o, "Unknown role %s.\n\r", args.String("role"))
+			return
+		}
+		userManager.SetRole(u.UID, role)
+		fmt.Fprintf(o, "%s is %s now.\n\r", u.Username, roleNames[role])
+	})
+
+	cm.AddCommandWithRole("staff", "List the moderators and admins", ROLE_MODERATOR, func(from string, args CommandArgs, o io.Writer) {
+		for _, r := range userManager.GetStaff() {
+			name := fmt.Sprint(r.UID)
+			if u, ok := userManager.GetUserByUID(r.UID); ok {
+				name = u.Username
+			}
+			fmt.Fprintf(o, "%s: %s\n\r", roleNames[r.Role], name)
+		}
+	})
 }
 
 func initIrcCommand(cm *CommandManager) {
-	cm.AddCallback("logout", func(from string, args []string, o io.Writer) {
-		userBukkit.Kick(from, fmt.Sprintf("You are taken offline by the %s.", from))
-	}, "", 0)
+	cm.AddCommand("logout [id:int]", "Log out all your Sync connections, or one of them", func(from string, args CommandArgs, o io.Writer) {
+		reason := fmt.Sprintf("You are taken offline by the %s.", from)
+		clients := userBukkit.GetClientsByNick(from)
+		if !args.Has("id") {
+			for _, c := range clients {
+				userBukkit.KickClient(c, reason)
+			}
+			return
+		}
+
+		id := args.Int("id")
+		for _, c := range clients {
+			if c.id == id {
+				userBukkit.KickClient(c, reason)
+				return
+			}
+		}
+		fmt.Fprintf(o, "Connection #%d does not exist.", id)
+	})
+
+	cm.AddCommand("pair <code>", "Pair your Sync with the code it shows", func(from string, args CommandArgs, o io.Writer) {
+		clients := userBukkit.GetClientsByNick(from)
+		if len(clients) == 0 {
+			fmt.Fprint(o, "Your Sync is offline.")
+			return
+		}
 
-	cm.AddCallback("assign_token", func(from string, args []string, o io.Writer) {
 		var c *Client
-		var ok bool
-		if c, ok = userBukkit.GetClient(from); !ok {
+		for _, candidate := range clients {
+			if len(candidate.pairingCode) > 0 && strings.EqualFold(args.String("code"), candidate.pairingCode) {
+				c = candidate
+				break
+			}
+		}
+
+		if c == nil {
+			fmt.Fprint(o, "The pairing code is incorrect.")
+			return
+		}
+
+		if !c.pair(c.deviceName) {
+			fmt.Fprint(o, "Pairing failed, please try again later.")
+			return
+		}
+		fmt.Fprint(o, "Your Sync is paired.")
+	})
+
+	cm.AddCommand("devices", "List your paired devices", func(from string, args CommandArgs, o io.Writer) {
+		if !userManager.ExistByUsername(from) {
+			fmt.Fprint(o, "No device is paired.")
+			return
+		}
+		printDevices(o, userManager.GetUIDByUsername(from), "")
+	})
+
+	cm.AddCommand("name_device <id:int> <name...>", "Rename one of your devices", func(from string, args CommandArgs, o io.Writer) {
+		id := args.Int("id")
+		if !userManager.ExistByUsername(from) {
+			fmt.Fprintf(o, "Device #%d does not exist.", id)
+			return
+		}
+		if !userManager.RenameDevice(userManager.GetUIDByUsername(from), id, args.String("name")) {
+			fmt.Fprintf(o, "Device #%d does not exist.", id)
+			return
+		}
+		fmt.Fprintf(o, "Device #%d is renamed.", id)
+	})
+
+	cm.AddCommand("revoke <id:int>", "Revoke one of your devices", func(from string, args CommandArgs, o io.Writer) {
+		id := args.Int("id")
+		if !userManager.ExistByUsername(from) {
+			fmt.Fprintf(o, "Device #%d does not exist.", id)
+			return
+		}
+		if !revokeDevice(userManager.GetUIDByUsername(from), from, id, fmt.Sprintf("The device is revoked by the %s.", from)) {
+			fmt.Fprintf(o, "Device #%d does not exist.", id)
+			return
+		}
+		fmt.Fprintf(o, "Device #%d is revoked.", id)
+	})
+
+	cm.AddCommand("status", "Show your Sync connections, messages left and restriction", func(from string, args CommandArgs, o io.Writer) {
+		clients := userBukkit.GetClientsByNick(from)
+		name := from
+		if len(clients) == 0 {
+			fmt.Fprint(o, "Your Sync isn't connected.\n\r")
+		} else {
+			name = clients[0].user.Username
+		}
+		for _, c := range clients {
+			paired := "not paired"
+			if c.Paired() {
+				paired = "paired"
+			}
+			fmt.Fprintf(o, "Sync #%d is connected with plugin %s, %s.\n\r", c.id, c.version, paired)
+		}
+
+		left := config.MaxMessageCountPerMinute - userBukkit.MessageCount(name)
+		if left < 0 {
+			left = 0
+		}
+		fmt.Fprintf(o, "You can send %d more messages from Sync this minute, the count resets in %s.\n\r",
+			left, userBukkit.QuotaResetIn().Round(time.Second))
+
+		if u, ok := userManager.GetUserByUsername(from); ok && u.IsBanned() {
+			fmt.Fprintf(o, "You are restricted for %s more.\n\r", u.GetBannedETA().Round(time.Second))
+		}
+	})
+
+	cm.AddCommand("pp [mode]", "Show your pp stored by the server, mode is std, taiko, ctb or mania", func(from string, args CommandArgs, o io.Writer) {
+		u, ok := userManager.GetUserByUsername(from)
+		if !ok {
+			fmt.Fprint(o, "Your pp isn't known yet, connect Sync once first.\n\r")
+			return
+		}
+
+		modes := []struct {
+			name string
+			pp   float64
+		}{{"std", u.StdPP}, {"taiko", u.TaikoPP}, {"ctb", u.CtbPP}, {"mania", u.ManiaPP}}
+
+		pps := []string{}
+		for _, mode := range modes {
+			if args.Has("mode") && !strings.EqualFold(args.String("mode"), mode.name) {
+				continue
+			}
+			if isLessZerof(mode.pp) {
+				pps = append(pps, fmt.Sprintf("%s: unknown", mode.name))
+				continue
+			}
+			pps = append(pps, fmt.Sprintf("%s: %.2fpp", mode.name, mode.pp))
+		}
+		if len(pps) == 0 {
+			fmt.Fprintf(o, "There is no mode %s, use std, taiko, ctb or mania.\n\r", args.String("mode"))
+			return
+		}
+		fmt.Fprintf(o, "%s\n\r", strings.Join(pps, ", "))
+	})
+
+	cm.AddCommand("version", "Show the server version and the supported plugin versions", func(from string, args CommandArgs, o io.Writer) {
+		fmt.Fprintf(o, "Server %s.\n\r", VERSION)
+		if minPluginVersion != nil {
+			fmt.Fprintf(o, "The plugin needs to be %s or later.\n\r", minPluginVersion)
+		}
+		for _, c := range userBukkit.GetClientsByNick(from) {
+			if isDeprecatedPluginVersion(c.version) {
+				fmt.Fprintf(o, "Your plugin %s is outdated, please update it to %s or later.\n\r", c.version, deprecatedPluginVersion)
+				break
+			}
+		}
+	})
+
+	cm.AddCommand("set <name> <value>", "Turn a preference on or off, send !get to see them", func(from string, args CommandArgs, o io.Writer) {
+		on, ok := parseSwitch(args.String("value"))
+		if !ok {
+			fmt.Fprintf(o, "Use on or off, not %s.\n\r", args.String("value"))
+			return
+		}
+
+		name := strings.ToLower(args.String("name"))
+		prefs := defaultPreferences()
+		if !prefs.Set(name, on) {
+			fmt.Fprintf(o, "There is no preference %s, send !get to see them.\n\r", name)
+			return
+		}
+
+		u, ok := getUser(from)
+		if !ok {
+			fmt.Fprint(o, "Your osu! account can't be found, please try again later.\n\r")
+			return
+		}
+		userManager.SetPreference(u.UID, name, on)
+		for _, c := range userBukkit.GetClientsByNick(from) {
+			c.reloadPreferences()
+		}
+		fmt.Fprintf(o, "%s is %s now.\n\r", name, switchName(on))
+	})
+
+	cm.AddCommand("get [name]", "Show your preferences", func(from string, args CommandArgs, o io.Writer) {
+		prefs := defaultPreferences()
+		if userManager.ExistByUsername(from) {
+			prefs = userManager.GetPreferences(userManager.GetUIDByUsername(from))
+		}
+
+		name := strings.ToLower(args.String("name"))
+		if _, ok := prefs.Get(name); len(name) > 0 && !ok {
+			fmt.Fprintf(o, "There is no preference %s.\n\r", name)
+			return
+		}
+		printPreferences(o, prefs, name)
+	})
+
+	cm.AddCommand("assign_token", "Send a token to your Sync", func(from string, args CommandArgs, o io.Writer) {
+		clients := userBukkit.GetClientsByNick(from)
+		if len(clients) == 0 {
 			fmt.Fprint(o, "Your Sync is offline.")
 			return
 		}
 
+		//prefer the connection waiting for this reply
+		c := clients[0]
+		for _, candidate := range clients {
+			if (candidate.status & WAIT_IRC_RPL) > 0 {
+				c = candidate
+				break
+			}
+		}
+
 		c.status &= ^WAIT_IRC_RPL
 
-		if c.version.LessThan(VERSION) {
-			fmt.Fprintf(o, "The PublicOsuBotTransfer plugin that is lower than the %s version does not support this command.", VERSION)
+		if !c.Paired() {
+			fmt.Fprint(o, "Your Sync is not paired. Pair it first.")
+			return
+		}
+
+		if !c.Can(CAP_TOKEN) {
+			fmt.Fprintf(o, "Your PublicOsuBotTransfer plugin does not support this command. Please update it to %s or later.", VERSION)
 			return
 		}
 
@@ -126,19 +504,65 @@ func initIrcCommand(cm *CommandManager) {
 		}
 
 		token := tokenManager.RequestToken(c)
-		tokenBytes := []byte(token)
-		buf := &bytes.Buffer{}
-		binary.Write(buf, binary.LittleEndian, struct {
-			cmd uint16
-			len int32
-		}{
-			cmd: RPL_TOKEN,
-			len: int32(len(tokenBytes)),
-		})
 		log.Infof("[Generate Token] %s: %s", c.user.Username, token)
-		c.SendBinaryToWS(append(buf.Bytes(), tokenBytes...))
+		c.SendTokenToWS(token)
 
-	}, "", 0)
+	})
+}
+
+func initWSCommand(wm *WSCommandManager) {
+	wm.AddHandler(REQ_TOKEN, "request_token", func(c *Client, req *WSRequest) {
+		c.requestToken(req)
+	})
+
+	wm.AddHandler(REQ_ACK_CAPABILITIES, "capabilities", func(c *Client, req *WSRequest) {
+		c.ackCapabilities(req)
+	})
+
+	wm.AddHandler(REQ_STATUS, "status", func(c *Client, req *WSRequest) {
+		c.Reply(req, RPL_STATUS, StatusReply{
+			ConnectionID:  c.id,
+			Connections:   int32(len(userBukkit.GetClients(c.user.Username))),
+			Paired:        c.Paired(),
+			IRCOnline:     ircManager.IsOnline(c.user.Username),
+			TokenAssigned: tokenManager.TokenRequested(c),
+			Bridged:       ircManager.Bridged(),
+		})
+	})
+
+	wm.AddHandler(REQ_QUOTA, "quota", func(c *Client, req *WSRequest) {
+		used := userBukkit.MessageCount(c.user.Username)
+		remaining := config.MaxMessageCountPerMinute - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		c.Reply(req, RPL_QUOTA, QuotaReply{
+			Limit:     config.MaxMessageCountPerMinute,
+			Used:      used,
+			Remaining: remaining,
+			ResetIn:   int32(userBukkit.QuotaResetIn() / time.Second),
+		})
+	})
+
+	wm.AddHandler(REQ_PP, "pp", func(c *Client, req *WSRequest) {
+		c.Reply(req, RPL_PP, PPReply{
+			Std:   c.user.StdPP,
+			Taiko: c.user.TaikoPP,
+			Ctb:   c.user.CtbPP,
+			Mania: c.user.ManiaPP,
+		})
+	})
+
+	wm.AddHandler(REQ_VERSION, "version", func(c *Client, req *WSRequest) {
+		c.Reply(req, RPL_VERSION, VersionReply{
+			Server:   VERSION.String(),
+			Protocol: int32(c.protocol),
+		})
+	})
+
+	wm.AddHandler(REQ_PREFERENCES, "preferences", func(c *Client, req *WSRequest) {
+		c.Reply(req, RPL_PREFERENCES, c.Preferences())
+	})
 }
 
 func initServer() {
@@ -150,14 +574,22 @@ func initServer() {
 			panic("Can't parse config.json")
 		}
 	}
+	loadVersionPolicy()
 
 	// Is the logs folder exist? if no, create it.
 	if _, err := os.Stat("logs"); os.IsNotExist(err) {
 		os.Mkdir("logs", os.ModePerm)
 	}
 
+	if devMode {
+		userManager = NewUserManager(devDBFile)
+	} else {
+		userManager = NewUserManager(dbFile)
+	}
+
 	// osu web api
 	osuAPI = NewOsuAPI(config.APIKey)
+	osuAPI.dev = devMode
 	logFile, err := os.OpenFile(fmt.Sprintf("logs/log-%s.log", time.Now().Format("20060102-15-04-05")), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, os.ModePerm)
 	if err != nil {
 		panic(err)
@@ -171,18 +603,40 @@ func initServer() {
 
 	logging.SetBackend(fileBackendFormatter, stdoutBackendFormatter)
 
-	stdinCmd := NewCommandManager(true)
+	stdinCmd := NewCommandManager("", true)
 	initStdinCommand(stdinCmd)
+	initModerationCommand(stdinCmd)
+	initAdminAPI(stdinCmd)
 	go stdinCmd.ReadStdinPump()
 
-	ircCmd := NewCommandManager(false)
+	ircCmd := NewCommandManager("!", true)
+	ircCmd.roleOf = ircRole
 	initIrcCommand(ircCmd)
+	initModerationCommand(ircCmd)
+
+	initWSCommand(wsCommandManager)
+
+	if devMode {
+		fakeBancho, err := StartFakeBancho("127.0.0.1:0")
+		if err != nil {
+			panic(err)
+		}
+		config.IRCServer, config.IRCPort = fakeBancho.Addr()
+		config.IRCTLS = false
+		if config.Username == "" {
+			config.Username = "DevBot"
+		}
+		initDevCommand(stdinCmd, fakeBancho)
+	}
 
 	ircManager = NewIrc(ircCmd)
 	go userBukkit.Run()
 }
 
 func main() {
+	flag.BoolVar(&devMode, "dev", false, "Connect to a built-in fake Bancho and fake the osu! api")
+	flag.Parse()
+
 	initServer()
 
 	http.HandleFunc(config.Path, func(rw http.ResponseWriter, req *http.Request) {
@@ -200,16 +654,72 @@ func main() {
 			versionStr = versionCookie.Value
 		}
 
-		ver := version.Must(version.NewVersion(versionStr))
+		ver, err := version.NewVersion(versionStr)
+		if err != nil {
+			log.Warningf("[Server] Malformed plugin version: %s", versionStr)
+			ver = nil
+		}
 
-		name := strings.Replace(nameCookie.Value, " ", "_", -1)
-		StartWS(name, rw, req, ver)
+		connectReq := &ConnectRequest{
+			Name:       strings.Replace(nameCookie.Value, " ", "_", -1),
+			Version:    ver,
+			DeviceName: "Sync",
+		}
+
+		if resumeCookie, err := req.Cookie("resume_id"); err == nil {
+			connectReq.Resume = &ResumeRequest{ID: resumeCookie.Value}
+			if seqCookie, err := req.Cookie("resume_seq"); err == nil {
+				connectReq.Resume.Seq, _ = strconv.ParseUint(seqCookie.Value, 10, 64)
+			}
+		}
+
+		if secretCookie, err := req.Cookie("device_secret"); err == nil {
+			connectReq.DeviceSecret = secretCookie.Value
+		}
+		if deviceNameCookie, err := req.Cookie("device_name"); err == nil && len(deviceNameCookie.Value) > 0 {
+			connectReq.DeviceName = deviceNameCookie.Value
+		}
+
+		StartWS(connectReq, rw, req)
+	})
+
+	http.HandleFunc("/api/health", func(rw http.ResponseWriter, req *http.Request) {
+		state, since := ircManager.State()
+		authenticated, authError := ircManager.Authenticated()
+		users, clients := userBukkit.Count()
+
+		healthJSON := struct {
+			Healthy       bool   `json:"healthy"`
+			IRCState      string `json:"ircState"`
+			IRCSince      int64  `json:"ircSince"` // unix time
+			Authenticated bool   `json:"authenticated"`
+			Error         string `json:"error,omitempty"`
+			Reconnects    int    `json:"reconnects"`
+			Users         int    `json:"users"`
+			Clients       int    `json:"clients"`
+		}{
+			Healthy:       state == IRC_JOINED,
+			IRCState:      ircStateNames[state],
+			IRCSince:      since.Unix(),
+			Authenticated: authenticated,
+			Error:         authError,
+			Reconnects:    ircManager.Reconnects(),
+			Users:         users,
+			Clients:       clients,
+		}
+
+		json, _ := json.Marshal(healthJSON)
+		if !healthJSON.Healthy {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		rw.Write(json)
 	})
 
 	http.HandleFunc("/api/is_online", func(rw http.ResponseWriter, req *http.Request) {
 		onlineJSON := struct {
-			IRCOnline  bool `json:"ircOnline"`
-			SyncOnline bool `json:"syncOnline"`
+			IRCOnline  bool  `json:"ircOnline"`
+			SyncOnline bool  `json:"syncOnline"`
+			LastSeen   int64 `json:"lastSeen"` // unix time on IRC, 0 if unknown
 		}{
 			IRCOnline:  false,
 			SyncOnline: false,
@@ -231,6 +741,10 @@ func main() {
 			onlineJSON.IRCOnline = true
 		}
 
+		if lastSeen, ok := ircManager.presence.LastSeen(name[0]); ok {
+			onlineJSON.LastSeen = lastSeen.Unix()
+		}
+
 		json, _ := json.Marshal(onlineJSON)
 		rw.Write(json)
 	})
@@ -245,7 +759,7 @@ func main() {
 		query := req.URL.Query()
 		if name, ok := query["u"]; ok && len(name) > 0 {
 			if k, ok := query["k"]; ok && len(k) > 0 {
-				if c, ok := userBukkit.GetClient(name[0]); ok {
+				for _, c := range userBukkit.GetClients(name[0]) {
 					if token, ok := tokenManager.Token(c); ok {
 						if k[0] == token {
 							validJSON.Valid = true
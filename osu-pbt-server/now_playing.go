@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// /np of osu! stable and lazer, e.g.
+//
+//	\x01ACTION is listening to [https://osu.ppy.sh/b/123 Artist - Title [Hard]]\x01
+//	\x01ACTION is playing [https://osu.ppy.sh/beatmapsets/1#taiko/123 Artist - Title [Hard]] +Hidden <Taiko>\x01
+var nowPlayingRegex = regexp.MustCompile(`^\x01ACTION is (listening to|playing|watching|editing) \[https?://osu\.ppy\.sh/(?:b/|beatmapsets/\d+#\w+/)(\d+) ((?:[^\[\]]|\[[^\]]*\])*)\](.*)\x01$`)
+
+var (
+	nowPlayingModRegex  = regexp.MustCompile(`\+(\w+)`)
+	nowPlayingModeRegex = regexp.MustCompile(`<([^>]+)>`)
+)
+
+// parseNowPlaying parses a /np CTCP ACTION, the beatmap isn't looked up yet.
+func parseNowPlaying(msg string) (NowPlayingData, bool) {
+	match := nowPlayingRegex.FindStringSubmatch(msg)
+	if len(match) == 0 {
+		return NowPlayingData{}, false
+	}
+
+	beatmapID, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil {
+		return NowPlayingData{}, false
+	}
+
+	np := NowPlayingData{
+		Action:    match[1],
+		BeatmapID: beatmapID,
+		Mods:      []string{},
+		Title:     match[3],
+	}
+
+	for _, mod := range nowPlayingModRegex.FindAllStringSubmatch(match[4], -1) {
+		np.Mods = append(np.Mods, mod[1])
+	}
+
+	if mode := nowPlayingModeRegex.FindStringSubmatch(match[4]); len(mode) > 0 {
+		name := mode[1]
+		if strings.EqualFold(name, "osu!mania") {
+			name = "Mania"
+		}
+		if m := modeStringToInt(name); m > 0 {
+			np.Mode = int32(m)
+		}
+	}
+	return np, true
+}
+
+// enrich fills in the beatmap from the osu! api, the title of the /np is kept if it fails.
+func (np *NowPlayingData) enrich() {
+	beatmap, ok := osuAPI.GetBeatmap(np.BeatmapID, int(np.Mode))
+	if ok {
+		np.Title, _ = beatmap["title"].(string)
+		np.Artist, _ = beatmap["artist"].(string)
+		np.Version, _ = beatmap["version"].(string)
+		if stars, ok := beatmap["difficultyrating"].(string); ok {
+			np.Stars, _ = strconv.ParseFloat(stars, 64)
+		}
+	}
+	np.Text = np.line()
+}
+
+// line renders the now playing event for viewers.
+func (np *NowPlayingData) line() string {
+	var b strings.Builder
+	b.WriteString("Now playing: ")
+	if len(np.Artist) > 0 {
+		fmt.Fprintf(&b, "%s - %s [%s]", np.Artist, np.Title, np.Version)
+	} else {
+		b.WriteString(np.Title)
+	}
+	for _, mod := range np.Mods {
+		fmt.Fprintf(&b, " +%s", mod)
+	}
+	if np.Stars > 0 {
+		fmt.Fprintf(&b, " (%.2f*)", np.Stars)
+	}
+	return b.String()
+}
+
+// SendNowPlayingToWS sends a now playing event, as a now-playing envelope on v2,
+// or the rendered line plus RPL_NOW_PLAYING on the binary protocol.
+func (c *Client) SendNowPlayingToWS(np NowPlayingData) {
+	if c.protocol == PROTOCOL_V2 {
+		if frame, ok := c.session.record(ENVELOPE_NOW_PLAYING, 0, np, np.Text); ok {
+			c.enqueue(frame)
+		}
+		return
+	}
+
+	c.SendMessageToWS(np.Text)
+	if c.Can(CAP_NOW_PLAYING) {
+		c.SendBinaryToWS(c.encodeFrame(RPL_NOW_PLAYING, 0, np))
+	}
+}
+
+// RecordNowPlaying buffers a now playing event for a detached session.
+func (s *Session) RecordNowPlaying(np NowPlayingData) {
+	s.record(ENVELOPE_NOW_PLAYING, 0, np, np.Text)
+}
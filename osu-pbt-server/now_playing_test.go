@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNowPlaying(t *testing.T) {
+	tests := []struct {
+		msg string
+		np  NowPlayingData
+		ok  bool
+	}{
+		{
+			"\x01ACTION is listening to [https://osu.ppy.sh/b/123 Artist - Title [Hard]]\x01",
+			NowPlayingData{Action: "listening to", BeatmapID: 123, Mods: []string{}, Title: "Artist - Title [Hard]"},
+			true,
+		},
+		{
+			"\x01ACTION is playing [https://osu.ppy.sh/beatmapsets/1#taiko/456 Artist - Title [Oni]] +Hidden +HardRock <Taiko>\x01",
+			NowPlayingData{Action: "playing", BeatmapID: 456, Mods: []string{"Hidden", "HardRock"}, Mode: 1, Title: "Artist - Title [Oni]"},
+			true,
+		},
+		{
+			"\x01ACTION is playing [https://osu.ppy.sh/beatmapsets/2#mania/789 Artist - Title [4K]] <osu!mania>\x01",
+			NowPlayingData{Action: "playing", BeatmapID: 789, Mods: []string{}, Mode: 3, Title: "Artist - Title [4K]"},
+			true,
+		},
+		{
+			"\x01ACTION is watching [http://osu.ppy.sh/b/1 A - B [C]] <CatchTheBeat>\x01",
+			NowPlayingData{Action: "watching", BeatmapID: 1, Mods: []string{}, Mode: 2, Title: "A - B [C]"},
+			true,
+		},
+		{
+			"\x01ACTION is editing [https://osu.ppy.sh/b/5 A - B]\x01",
+			NowPlayingData{Action: "editing", BeatmapID: 5, Mods: []string{}, Title: "A - B"},
+			true,
+		},
+		{"hello", NowPlayingData{}, false},
+		{"\x01ACTION waves\x01", NowPlayingData{}, false},
+		{"\x01ACTION is playing [https://example.com/b/1 A - B [C]]\x01", NowPlayingData{}, false},
+		{"\x01ACTION is playing [https://osu.ppy.sh/b/1 A - B [C]]", NowPlayingData{}, false},
+		{"is playing [https://osu.ppy.sh/b/1 A - B [C]]", NowPlayingData{}, false},
+		{"\x01ACTION is playing [https://osu.ppy.sh/b/99999999999999999999 A]\x01", NowPlayingData{}, false},
+	}
+
+	for _, test := range tests {
+		np, ok := parseNowPlaying(test.msg)
+		if ok != test.ok {
+			t.Errorf("parseNowPlaying(%q) ok = %v, want %v", test.msg, ok, test.ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(np, test.np) {
+			t.Errorf("parseNowPlaying(%q) = %+v, want %+v", test.msg, np, test.np)
+		}
+	}
+}
+
+func TestNowPlayingLine(t *testing.T) {
+	tests := []struct {
+		np   NowPlayingData
+		line string
+	}{
+		{NowPlayingData{Title: "Artist - Title [Hard]", Mods: []string{}}, "Now playing: Artist - Title [Hard]"},
+		{
+			NowPlayingData{Artist: "Artist", Title: "Title", Version: "Insane", Mods: []string{"Hidden"}, Stars: 5.254},
+			"Now playing: Artist - Title [Insane] +Hidden (5.25*)",
+		},
+	}
+
+	for _, test := range tests {
+		if line := test.np.line(); line != test.line {
+			t.Errorf("line() = %q, want %q", line, test.line)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Names of the user preferences, edited with !set and !get.
+const (
+	PREF_PP_DELTA = "ppdelta"
+	PREF_WELCOME  = "welcome"
+	PREF_PRESENCE = "presence"
+)
+
+type preference struct {
+	name   string
+	detail string
+}
+
+var preferenceList = []preference{
+	{PREF_PP_DELTA, "add the pp change to RTPPD messages"},
+	{PREF_WELCOME, "welcome notices when Sync connects"},
+	{PREF_PRESENCE, "notices when you join or leave the game"},
+}
+
+// Preferences are the effective preferences of a user, everything is on by default.
+// It's also the payload of RPL_PREFERENCES.
+type Preferences struct {
+	PPDelta  bool `json:"ppdelta"`
+	Welcome  bool `json:"welcome"`
+	Presence bool `json:"presence"`
+}
+
+func defaultPreferences() Preferences {
+	return Preferences{
+		PPDelta:  true,
+		Welcome:  true,
+		Presence: true,
+	}
+}
+
+func (p *Preferences) field(name string) (*bool, bool) {
+	switch name {
+	case PREF_PP_DELTA:
+		return &p.PPDelta, true
+	case PREF_WELCOME:
+		return &p.Welcome, true
+	case PREF_PRESENCE:
+		return &p.Presence, true
+	}
+	return nil, false
+}
+
+// Get returns a preference by name.
+func (p Preferences) Get(name string) (bool, bool) {
+	field, ok := p.field(name)
+	if !ok {
+		return false, false
+	}
+	return *field, true
+}
+
+// Set changes a preference by name, it returns false for an unknown name.
+func (p *Preferences) Set(name string, on bool) bool {
+	field, ok := p.field(name)
+	if ok {
+		*field = on
+	}
+	return ok
+}
+
+// parseSwitch accepts on/off and its usual spellings.
+func parseSwitch(s string) (bool, bool) {
+	switch strings.ToLower(s) {
+	case "on", "true", "yes", "1":
+		return true, true
+	case "off", "false", "no", "0":
+		return false, true
+	}
+	return false, false
+}
+
+func switchName(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// printPreferences writes one preference per line, or all of them if name is "".
+func printPreferences(o io.Writer, prefs Preferences, name string) {
+	for _, pref := range preferenceList {
+		if len(name) > 0 && name != pref.name {
+			continue
+		}
+		on, _ := prefs.Get(pref.name)
+		fmt.Fprintf(o, "%s: %s (%s)\n\r", pref.name, switchName(on), pref.detail)
+	}
+}
+
+// Preferences returns the preferences of the user of the client, loaded when it connected.
+func (c *Client) Preferences() Preferences {
+	c.prefsMu.Lock()
+	defer c.prefsMu.Unlock()
+	return c.prefs
+}
+
+// reloadPreferences reads the preferences again after a !set.
+func (c *Client) reloadPreferences() {
+	prefs := userManager.GetPreferences(c.user.UID)
+
+	c.prefsMu.Lock()
+	c.prefs = prefs
+	c.prefsMu.Unlock()
+}
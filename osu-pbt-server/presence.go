@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	presenceResyncInterval = 5 * time.Minute
+	// an online user not confirmed for this long is considered offline
+	presenceStaleAfter = 3 * presenceResyncInterval
+	// offline users are forgotten after this
+	presenceForgetAfter = 24 * time.Hour
+)
+
+type presence struct {
+	nick     string
+	online   bool
+	lastSeen time.Time
+}
+
+// PresenceTracker knows which users are in #osu,
+// kept up to date by JOIN/PART/QUIT/KICK/NICK and a periodic NAMES resync.
+type PresenceTracker struct {
+	mu    sync.RWMutex
+	users map[string]*presence // by normalizeNick
+
+	// onChange is called when a user comes online or goes offline.
+	// Losing the connection to Bancho isn't a change, users are compared
+	// with the state last reported.
+	onChange func(nick string, online bool)
+	reported map[string]bool
+
+	names    map[string]string // NAMES reply in progress
+	lastSync time.Time
+}
+
+// normalizeNick folds case, channel modes and the space/underscore difference of osu! names.
+func normalizeNick(nick string) string {
+	nick = strings.TrimLeft(nick, "@+")
+	return strings.ToLower(strings.Replace(nick, " ", "_", -1))
+}
+
+type presenceChange struct {
+	nick   string
+	online bool
+}
+
+// changes collects the users whose state differs from the last report, p.mu must be held.
+func (p *PresenceTracker) changes(keys ...string) []presenceChange {
+	changes := []presenceChange{}
+	for _, key := range keys {
+		user, ok := p.users[key]
+		if !ok || p.reported[key] == user.online {
+			continue
+		}
+		p.reported[key] = user.online
+		changes = append(changes, presenceChange{user.nick, user.online})
+	}
+	return changes
+}
+
+func (p *PresenceTracker) report(changes []presenceChange) {
+	if p.onChange == nil {
+		return
+	}
+	for _, change := range changes {
+		p.onChange(change.nick, change.online)
+	}
+}
+
+func (p *PresenceTracker) set(nick string, online bool) {
+	key := normalizeNick(nick)
+	user, ok := p.users[key]
+	if !ok {
+		user = &presence{}
+		p.users[key] = user
+	}
+	user.nick = strings.TrimLeft(nick, "@+")
+	user.online = online
+	user.lastSeen = time.Now()
+}
+
+// Join marks a user online.
+func (p *PresenceTracker) Join(nick string) {
+	p.mu.Lock()
+	p.set(nick, true)
+	changes := p.changes(normalizeNick(nick))
+	p.mu.Unlock()
+
+	p.report(changes)
+}
+
+// Leave marks a user offline after PART, QUIT or KICK.
+func (p *PresenceTracker) Leave(nick string) {
+	p.mu.Lock()
+	p.set(nick, false)
+	changes := p.changes(normalizeNick(nick))
+	p.mu.Unlock()
+
+	p.report(changes)
+}
+
+// Seen marks a user online who sent a message to the bot.
+func (p *PresenceTracker) Seen(nick string) {
+	p.mu.Lock()
+	p.set(nick, true)
+	changes := p.changes(normalizeNick(nick))
+	p.mu.Unlock()
+
+	p.report(changes)
+}
+
+// Rename moves the presence of a user to the new nick.
+func (p *PresenceTracker) Rename(oldNick string, newNick string) {
+	p.mu.Lock()
+	p.set(oldNick, false)
+	p.set(newNick, true)
+	changes := p.changes(normalizeNick(oldNick), normalizeNick(newNick))
+	p.mu.Unlock()
+
+	p.report(changes)
+}
+
+// Names collects a 353 reply, it's applied by EndNames.
+func (p *PresenceTracker) Names(nicks []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.names == nil {
+		p.names = make(map[string]string)
+	}
+	for _, nick := range nicks {
+		if len(nick) > 0 {
+			p.names[normalizeNick(nick)] = nick
+		}
+	}
+}
+
+// EndNames handles 366, users missing from the NAMES reply are offline.
+func (p *PresenceTracker) EndNames() {
+	p.mu.Lock()
+
+	keys := []string{}
+	for key, user := range p.users {
+		if _, ok := p.names[key]; !ok && user.online {
+			user.online = false
+			user.lastSeen = time.Now()
+		}
+		if !user.online && time.Since(user.lastSeen) > presenceForgetAfter {
+			delete(p.users, key)
+			delete(p.reported, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	for key, nick := range p.names {
+		if _, ok := p.users[key]; !ok {
+			keys = append(keys, key)
+		}
+		p.set(nick, true)
+	}
+	p.names = nil
+	p.lastSync = time.Now()
+	changes := p.changes(keys...)
+	p.mu.Unlock()
+
+	p.report(changes)
+}
+
+// Clear marks everyone offline, the connection to Bancho was lost.
+func (p *PresenceTracker) Clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, user := range p.users {
+		if user.online {
+			user.online = false
+			user.lastSeen = time.Now()
+		}
+	}
+	p.names = nil
+}
+
+// IsOnline reports whether the user is in #osu,
+// a presence not confirmed within presenceStaleAfter doesn't count.
+func (p *PresenceTracker) IsOnline(nick string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	user, ok := p.users[normalizeNick(nick)]
+	return ok && user.online && time.Since(user.lastSeen) < presenceStaleAfter
+}
+
+// LastSeen returns when the user was last confirmed online or went offline.
+func (p *PresenceTracker) LastSeen(nick string) (time.Time, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	user, ok := p.users[normalizeNick(nick)]
+	if !ok {
+		return time.Time{}, false
+	}
+	return user.lastSeen, true
+}
+
+// Count returns the number of online users.
+func (p *PresenceTracker) Count() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	count := 0
+	for _, user := range p.users {
+		if user.online {
+			count++
+		}
+	}
+	return count
+}
+
+// LastSync returns when the last NAMES reply ended.
+func (p *PresenceTracker) LastSync() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.lastSync
+}
+
+func NewPresenceTracker(onChange func(nick string, online bool)) *PresenceTracker {
+	return &PresenceTracker{
+		users:    make(map[string]*presence),
+		onChange: onChange,
+		reported: make(map[string]bool),
+	}
+}
+
+// SendPresenceToWS pushes the in-game presence of the user,
+// as a presence envelope on v2 or a notice plus RPL_PRESENCE on the binary protocol.
+func (c *Client) SendPresenceToWS(online bool) {
+	if !c.Preferences().Presence {
+		return
+	}
+
+	data := PresenceData{
+		Nick:   c.user.Username,
+		Online: online,
+		Since:  time.Now().Unix(),
+	}
+
+	if c.protocol == PROTOCOL_V2 {
+		c.sendEnvelope(ENVELOPE_PRESENCE, 0, data)
+		return
+	}
+
+	if online {
+		c.SendNoticeToWS(fmt.Sprintf("%s is in game.", c.user.Username))
+	} else {
+		c.SendNoticeToWS(fmt.Sprintf("%s left the game.", c.user.Username))
+	}
+	if c.Can(CAP_PRESENCE) {
+		c.SendBinaryToWS(c.encodeFrame(RPL_PRESENCE, 0, data))
+	}
+}
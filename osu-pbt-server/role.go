@@ -0,0 +1,40 @@
+package main
+
+import "strings"
+
+// Roles of a user, a role includes the permissions of the lower ones.
+const (
+	ROLE_USER = iota
+	ROLE_MODERATOR
+	ROLE_ADMIN
+)
+
+var roleNames = map[int]string{
+	ROLE_USER:      "user",
+	ROLE_MODERATOR: "moderator",
+	ROLE_ADMIN:     "admin",
+}
+
+// Role is a row of the Roles table, users without a row are ROLE_USER.
+type Role struct {
+	UID  int64 `db:"uid"`
+	Role int   `db:"role"`
+}
+
+// parseRole looks up a role by name.
+func parseRole(name string) (int, bool) {
+	for role, roleName := range roleNames {
+		if strings.EqualFold(name, roleName) {
+			return role, true
+		}
+	}
+	return ROLE_USER, false
+}
+
+// ircRole returns the role of the user sending an IRC command.
+func ircRole(nick string) int {
+	if !userManager.ExistByUsername(nick) {
+		return ROLE_USER
+	}
+	return userManager.GetRole(userManager.GetUIDByUsername(nick))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// Overflow policies of the outbound queue of a client.
+const (
+	OVERFLOW_DROP_OLDEST = "drop-oldest"
+	OVERFLOW_DROP_NEWEST = "drop-newest"
+	OVERFLOW_DISCONNECT  = "disconnect"
+)
+
+const defaultSendQueueSize = 128
+
+// sendQueue is the bounded outbound queue of a client, pushing never blocks.
+type sendQueue struct {
+	mu     sync.Mutex
+	frames []wsFrame
+	notify chan struct{}
+
+	// overflow counters
+	overflows int64
+	dropped   int64
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{
+		notify: make(chan struct{}, 1),
+	}
+}
+
+func (q *sendQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop takes the oldest frame, ok is false if the queue is empty.
+func (q *sendQueue) pop() (wsFrame, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.frames) == 0 {
+		return wsFrame{}, false
+	}
+	frame := q.frames[0]
+	q.frames = q.frames[1:]
+	return frame, true
+}
+
+func (q *sendQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.frames)
+}
+
+// Overflows returns how often the queue was full and how many frames were dropped.
+func (q *sendQueue) Overflows() (int64, int64) {
+	return atomic.LoadInt64(&q.overflows), atomic.LoadInt64(&q.dropped)
+}
+
+// enqueue puts a frame into the outbound queue of the client,
+// a full queue is handled by config.OverflowPolicy.
+func (c *Client) enqueue(frame wsFrame) {
+	q := c.sendQueue
+	size := int(config.SendQueueSize)
+	if size <= 0 {
+		size = defaultSendQueueSize
+	}
+
+	q.mu.Lock()
+	if len(q.frames) < size {
+		q.frames = append(q.frames, frame)
+		q.mu.Unlock()
+		q.wake()
+		return
+	}
+
+	atomic.AddInt64(&q.overflows, 1)
+	switch config.OverflowPolicy {
+	case OVERFLOW_DROP_NEWEST:
+		atomic.AddInt64(&q.dropped, 1)
+
+	case OVERFLOW_DISCONNECT:
+		atomic.AddInt64(&q.dropped, int64(len(q.frames))+1)
+		c.status |= KICKED
+		q.frames = []wsFrame{{
+			msgType: websocket.CloseMessage,
+			data:    websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Sync can't keep up with the incoming messages."),
+		}}
+		log.Warningf("[WS] %s(#%d): outbound queue overflow, disconnecting", c.user.Username, c.id)
+
+	default: // OVERFLOW_DROP_OLDEST
+		atomic.AddInt64(&q.dropped, 1)
+		copy(q.frames, q.frames[1:])
+		q.frames[len(q.frames)-1] = frame
+	}
+	q.mu.Unlock()
+	q.wake()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestClient() *Client {
+	return &Client{
+		id:        1,
+		user:      &User{Username: "peppy"},
+		sendQueue: newSendQueue(),
+	}
+}
+
+func queuedData(q *sendQueue) []string {
+	data := []string{}
+	for {
+		frame, ok := q.pop()
+		if !ok {
+			return data
+		}
+		data = append(data, string(frame.data))
+	}
+}
+
+func TestSendQueueOverflow(t *testing.T) {
+	defer func(size int32, policy string) {
+		config.SendQueueSize, config.OverflowPolicy = size, policy
+	}(config.SendQueueSize, config.OverflowPolicy)
+	config.SendQueueSize = 3
+
+	tests := []struct {
+		policy    string
+		frames    int
+		data      []string
+		overflows int64
+		dropped   int64
+	}{
+		{OVERFLOW_DROP_OLDEST, 2, []string{"1", "2"}, 0, 0},
+		{OVERFLOW_DROP_OLDEST, 5, []string{"3", "4", "5"}, 2, 2},
+		{"", 5, []string{"3", "4", "5"}, 2, 2},
+		{OVERFLOW_DROP_NEWEST, 5, []string{"1", "2", "3"}, 2, 2},
+	}
+
+	for _, test := range tests {
+		config.OverflowPolicy = test.policy
+		c := newTestClient()
+		for i := 1; i <= test.frames; i++ {
+			c.enqueue(wsFrame{msgType: websocket.TextMessage, data: []byte(fmt.Sprint(i))})
+		}
+
+		overflows, dropped := c.sendQueue.Overflows()
+		if overflows != test.overflows || dropped != test.dropped {
+			t.Errorf("%q: overflows %d, dropped %d, want %d, %d", test.policy, overflows, dropped, test.overflows, test.dropped)
+		}
+		if data := queuedData(c.sendQueue); !reflect.DeepEqual(data, test.data) {
+			t.Errorf("%q: queued %q, want %q", test.policy, data, test.data)
+		}
+		if (c.status & KICKED) > 0 {
+			t.Errorf("%q: the client is kicked", test.policy)
+		}
+	}
+}
+
+func TestSendQueueOverflowDisconnect(t *testing.T) {
+	defer func(size int32, policy string) {
+		config.SendQueueSize, config.OverflowPolicy = size, policy
+	}(config.SendQueueSize, config.OverflowPolicy)
+	config.SendQueueSize = 3
+	config.OverflowPolicy = OVERFLOW_DISCONNECT
+
+	c := newTestClient()
+	for i := 1; i <= 4; i++ {
+		c.enqueue(wsFrame{msgType: websocket.TextMessage, data: []byte(fmt.Sprint(i))})
+	}
+
+	if (c.status & KICKED) == 0 {
+		t.Error("the client isn't kicked")
+	}
+	if overflows, dropped := c.sendQueue.Overflows(); overflows != 1 || dropped != 4 {
+		t.Errorf("overflows %d, dropped %d, want 1, 4", overflows, dropped)
+	}
+
+	frame, ok := c.sendQueue.pop()
+	if !ok || frame.msgType != websocket.CloseMessage {
+		t.Errorf("the first frame is %+v, want a close frame", frame)
+	}
+	if c.sendQueue.Len() != 0 {
+		t.Errorf("%d frames are left after the close frame", c.sendQueue.Len())
+	}
+}
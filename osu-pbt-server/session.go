@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lithammer/shortuuid"
+)
+
+// wsFrame is a outbound WebSocket frame.
+// seq is the envelope id of a v2 frame, 0 for frames that can't be replayed.
+type wsFrame struct {
+	msgType int
+	seq     uint64
+	data    []byte
+}
+
+type sessionFrame struct {
+	wsFrame
+	chat string // text of a chat frame, moved to the mailbox if the session expires
+}
+
+// ResumeRequest is sent by a reconnecting client through the resume_id and resume_seq cookies.
+type ResumeRequest struct {
+	ID  string
+	Seq uint64 // last envelope id received by the client, 0 if unknown
+}
+
+// Session is the state of a v2 connection, it numbers and buffers the outbound envelopes.
+// It outlives its Client for config.ResumeGracePeriod seconds after an unexpected disconnect.
+type Session struct {
+	id     string
+	uid    int64
+	name   string
+	client *Client
+
+	mu       sync.Mutex
+	seq      uint64
+	written  uint64
+	frames   []sessionFrame
+	detached bool
+	expire   *time.Timer
+}
+
+// record encodes a envelope and keeps it in the frame buffer.
+func (s *Session) record(envelopeType string, replyTo uint64, data interface{}, chat string) (wsFrame, bool) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		log.Errorf("[WS] %s: Can't encode %s envelope. (%s)", s.name, envelopeType, err)
+		return wsFrame{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	envelope, _ := json.Marshal(Envelope{
+		ID:      s.seq,
+		Type:    envelopeType,
+		ReplyTo: replyTo,
+		Data:    raw,
+	})
+
+	frame := sessionFrame{
+		wsFrame: wsFrame{msgType: websocket.TextMessage, seq: s.seq, data: envelope},
+		chat:    chat,
+	}
+	if config.ResumeBufferSize > 0 {
+		if len(s.frames) >= int(config.ResumeBufferSize) {
+			copy(s.frames, s.frames[1:])
+			s.frames = s.frames[:len(s.frames)-1]
+		}
+		s.frames = append(s.frames, frame)
+	}
+
+	return frame.wsFrame, true
+}
+
+// RecordChat keeps a IRC message for a detached session.
+func (s *Session) RecordChat(text string) {
+	s.record(ENVELOPE_CHAT, 0, TextData{Text: text}, text)
+}
+
+// ack marks all frames up to seq as written to the socket.
+func (s *Session) ack(seq uint64) {
+	s.mu.Lock()
+	if seq > s.written {
+		s.written = seq
+	}
+	s.mu.Unlock()
+}
+
+// missed returns the buffered frames after seq and how many frames were already dropped from the buffer.
+func (s *Session) missed(seq uint64) ([]wsFrame, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq == 0 || seq > s.seq {
+		seq = s.written
+	}
+
+	frames := []wsFrame{}
+	for _, f := range s.frames {
+		if f.seq > seq {
+			frames = append(frames, f.wsFrame)
+		}
+	}
+	return frames, int(s.seq-seq) - len(frames)
+}
+
+// SessionManager keeps the sessions of all v2 clients.
+type SessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// New creates a session for a newly connected client.
+func (sm *SessionManager) New(c *Client) *Session {
+	s := &Session{
+		id:     shortuuid.New(),
+		uid:    c.user.UID,
+		name:   c.user.Username,
+		client: c,
+	}
+
+	sm.mu.Lock()
+	sm.sessions[s.id] = s
+	sm.mu.Unlock()
+	return s
+}
+
+// Detach keeps the session of a lost client alive for the grace period.
+func (sm *SessionManager) Detach(c *Client) {
+	s := c.session
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	s.detached = true
+	s.expire = time.AfterFunc(time.Duration(config.ResumeGracePeriod)*time.Second, func() {
+		sm.expireSession(s)
+	})
+	log.Infof("[Session] %s: %s detached", s.name, s.id)
+}
+
+// Resume attaches a detached session of the user to a new client.
+func (sm *SessionManager) Resume(id string, uid int64, c *Client) (*Session, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	s, ok := sm.sessions[id]
+	if !ok || !s.detached || s.uid != uid {
+		return nil, false
+	}
+
+	//expiration is already running
+	if !s.expire.Stop() {
+		return nil, false
+	}
+
+	tokenManager.MoveToken(s.client, c)
+	c.device = s.client.device
+	s.detached = false
+	s.client = c
+	s.name = c.user.Username
+	log.Infof("[Session] %s: %s resumed", s.name, s.id)
+	return s, true
+}
+
+// Remove drops the session of a client that left for good.
+func (sm *SessionManager) Remove(s *Session) {
+	sm.mu.Lock()
+	delete(sm.sessions, s.id)
+	sm.mu.Unlock()
+}
+
+// RemoveDevice drops the detached sessions of a revoked device.
+func (sm *SessionManager) RemoveDevice(id int64) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for sid, s := range sm.sessions {
+		if s.detached && s.client.Paired() && s.client.device.ID == id {
+			s.expire.Stop()
+			delete(sm.sessions, sid)
+		}
+	}
+}
+
+// Detached returns the detached sessions of a user, name is compared like an IRC nick.
+func (sm *SessionManager) Detached(name string) []*Session {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sessions := []*Session{}
+	for _, s := range sm.sessions {
+		if s.detached && normalizeNick(s.name) == normalizeNick(name) && s.client.Paired() {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+func (sm *SessionManager) expireSession(s *Session) {
+	sm.mu.Lock()
+	delete(sm.sessions, s.id)
+	sm.mu.Unlock()
+
+	if tokenManager.TokenRequested(s.client) {
+		tokenManager.RemoveToken(s.client)
+	}
+
+	//don't lose chat messages nobody has seen
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.frames {
+		if f.seq > s.written && len(f.chat) > 0 && config.MailboxSize > 0 {
+			userManager.PushMail(s.uid, f.chat)
+		}
+	}
+	log.Infof("[Session] %s: %s expired", s.name, s.id)
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: make(map[string]*Session),
+	}
+}
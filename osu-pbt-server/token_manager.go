@@ -7,11 +7,17 @@ type addTokenTuple struct {
 	token  string
 }
 
+type moveTokenTuple struct {
+	from *Client
+	to   *Client
+}
+
 type TokenManager struct {
 	clientTokenMap map[*Client]string
 
 	addToken    chan addTokenTuple
 	removeToken chan *Client
+	moveToken   chan moveTokenTuple
 }
 
 func (tm *TokenManager) RequestToken(c *Client) string {
@@ -29,6 +35,14 @@ func (tm *TokenManager) RemoveToken(c *Client) {
 	tm.removeToken <- c
 }
 
+// MoveToken hands the token of a client over to the client that resumed its session.
+func (tm *TokenManager) MoveToken(from *Client, to *Client) {
+	tm.moveToken <- moveTokenTuple{
+		from: from,
+		to:   to,
+	}
+}
+
 func (tm *TokenManager) Token(c *Client) (string, bool) {
 	if token, ok := tm.clientTokenMap[c]; ok {
 		return token, true
@@ -51,6 +65,12 @@ func (tm *TokenManager) loop() {
 
 		case client := <-tm.removeToken:
 			delete(tm.clientTokenMap, client)
+
+		case tuple := <-tm.moveToken:
+			if token, ok := tm.clientTokenMap[tuple.from]; ok {
+				delete(tm.clientTokenMap, tuple.from)
+				tm.clientTokenMap[tuple.to] = token
+			}
 		}
 	}
 }
@@ -60,6 +80,7 @@ func NewTokenManager() *TokenManager {
 		clientTokenMap: make(map[*Client]string),
 		addToken:       make(chan addTokenTuple, 16),
 		removeToken:    make(chan *Client, 16),
+		moveToken:      make(chan moveTokenTuple, 16),
 	}
 
 	go tm.loop()
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"time"
 )
 
@@ -44,6 +46,19 @@ func (u *User) IsBanned() bool {
 	return u.Banned == 1
 }
 
+// printUser writes the account, ban and connections of a user, lines end with "\n\r".
+func printUser(o io.Writer, u *User) {
+	fmt.Fprintf(o, "%s(%d)\n\r", u.Username, u.UID)
+	fmt.Fprintf(o, "First login: %s\n\r", time.Unix(0, u.FirstLoginDate*int64(time.Millisecond)).Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(o, "Last login: %s\n\r", time.Unix(0, u.LastLoginDate*int64(time.Millisecond)).Format("2006-01-02 15:04:05"))
+	if u.IsBanned() {
+		fmt.Fprintf(o, "Banned: %s left\n\r", u.GetBannedETA().Round(time.Second))
+	}
+	fmt.Fprintf(o, "Devices: %d\n\r", len(userManager.GetDevices(u.UID)))
+	fmt.Fprintf(o, "Connections: %d\n\r", len(userBukkit.GetClients(u.Username)))
+	fmt.Fprintf(o, "PP: std %.2f, taiko %.2f, ctb %.2f, mania %.2f\n\n\r", u.StdPP, u.TaikoPP, u.CtbPP, u.ManiaPP)
+}
+
 func (u *User) ApplyStdPPFromPpy() {
 	if pp, ok := osuAPI.GetUserPP(u.UID, 0); ok {
 		u.StdPP = pp
@@ -1,54 +1,214 @@
 package main
 
-import "github.com/gorilla/websocket"
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
 
 // UserBukkit is all online user collection.
+// A user can be online with several clients at the same time.
 type UserBukkit struct {
-	bukkit map[string]*Client
+	mu     sync.RWMutex
+	bukkit map[string]map[*Client]bool
+
+	// messages sent to IRC this minute, shared by all clients of a user
+	messageCount map[string]int32
+	quotaResetAt time.Time
 
-	add    chan *Client
 	remove chan *Client
 }
 
-func (b *UserBukkit) GetClient(name string) (*Client, bool) {
-	c, ok := b.bukkit[name]
+// GetClients returns all clients of the user.
+func (b *UserBukkit) GetClients(name string) []*Client {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(b.bukkit[name]))
+	for c := range b.bukkit[name] {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// Add puts a new client online, it returns false if the user
+// already has config.MaxClientsPerUser clients.
+func (b *UserBukkit) Add(c *Client) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	set, ok := b.bukkit[c.user.Username]
 	if !ok {
-		return nil, false
+		set = make(map[*Client]bool)
+		b.bukkit[c.user.Username] = set
+	}
+	if config.MaxClientsPerUser > 0 && len(set) >= int(config.MaxClientsPerUser) {
+		return false
+	}
+	set[c] = true
+	return true
+}
+
+// GetClientsByNick returns all clients of the user with the IRC nick.
+func (b *UserBukkit) GetClientsByNick(nick string) []*Client {
+	key := normalizeNick(nick)
+	for _, name := range b.Usernames() {
+		if normalizeNick(name) == key {
+			return b.GetClients(name)
+		}
+	}
+	return nil
+}
+
+// GetClientByID returns the client of the user with the connection id.
+func (b *UserBukkit) GetClientByID(name string, id int64) (*Client, bool) {
+	for _, c := range b.GetClients(name) {
+		if c.id == id {
+			return c, true
+		}
 	}
-	return c, true
+	return nil, false
 }
 
+// Kick closes all clients of the user.
 func (b *UserBukkit) Kick(name string, reason string) {
-	c, ok := b.bukkit[name]
-	if ok {
-		c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
-		c.conn.Close()
+	for _, c := range b.GetClients(name) {
+		b.KickClient(c, reason)
+	}
+}
+
+// KickClient closes one client.
+func (b *UserBukkit) KickClient(c *Client, reason string) {
+	c.status |= KICKED
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+	c.conn.Close()
+}
+
+// KickDevice closes the clients of the user that are using the device,
+// the name can be an IRC nick.
+func (b *UserBukkit) KickDevice(name string, deviceID int64, reason string) {
+	for _, c := range b.GetClientsByNick(name) {
+		if c.Paired() && c.device.ID == deviceID {
+			b.KickClient(c, reason)
+		}
+	}
+}
+
+// NoticeAll sends a notice to every online client.
+func (b *UserBukkit) NoticeAll(text string) {
+	for _, name := range b.Usernames() {
+		for _, c := range b.GetClients(name) {
+			c.SendNoticeToWS(text)
+		}
 	}
 }
 
 func (b *UserBukkit) IsOnline(name string) bool {
-	if _, ok := b.bukkit[name]; ok {
-		return true
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return len(b.bukkit[name]) > 0
+}
+
+// Count returns the number of online users and clients.
+func (b *UserBukkit) Count() (int, int) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	clients := 0
+	for _, set := range b.bukkit {
+		clients += len(set)
 	}
-	return false
+	return len(b.bukkit), clients
+}
+
+// Usernames returns the names of all online users.
+func (b *UserBukkit) Usernames() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	names := make([]string, 0, len(b.bukkit))
+	for name := range b.bukkit {
+		names = append(names, name)
+	}
+	return names
+}
+
+// TakeMessageQuota counts the IRC messages a message of the user is split into,
+// it returns false if they exceed config.MaxMessageCountPerMinute.
+func (b *UserBukkit) TakeMessageQuota(name string, parts int32) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.messageCount[name]+parts-1 > config.MaxMessageCountPerMinute {
+		return false
+	}
+	b.messageCount[name] += parts
+	return true
+}
+
+// ReturnMessageQuota gives back the quota of messages that were never sent.
+func (b *UserBukkit) ReturnMessageQuota(name string, parts int32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.messageCount[name] -= parts
+	if b.messageCount[name] <= 0 {
+		delete(b.messageCount, name)
+	}
+}
+
+// MessageCount returns the number of messages the user sent to IRC this minute.
+func (b *UserBukkit) MessageCount(name string) int32 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.messageCount[name]
+}
+
+// QuotaResetIn returns the time until the message counts are cleared.
+func (b *UserBukkit) QuotaResetIn() time.Duration {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return time.Until(b.quotaResetAt)
 }
 
 func (b *UserBukkit) Run() {
+	msgCountClearTicker := time.NewTicker(time.Minute)
+	defer msgCountClearTicker.Stop()
+
+	b.mu.Lock()
+	b.quotaResetAt = time.Now().Add(time.Minute)
+	b.mu.Unlock()
+
 	for {
 		select {
-		case c := <-b.add:
-			b.bukkit[c.user.Username] = c
 		case c := <-b.remove:
-			delete(b.bukkit, c.user.Username)
+			b.mu.Lock()
+			if set, ok := b.bukkit[c.user.Username]; ok {
+				delete(set, c)
+				if len(set) == 0 {
+					delete(b.bukkit, c.user.Username)
+				}
+			}
+			b.mu.Unlock()
+
+		case <-msgCountClearTicker.C:
+			b.mu.Lock()
+			b.messageCount = make(map[string]int32)
+			b.quotaResetAt = time.Now().Add(time.Minute)
+			b.mu.Unlock()
 		}
 	}
 }
 
 func NewBukkit() *UserBukkit {
 	return &UserBukkit{
-		bukkit: make(map[string]*Client),
+		bukkit:       make(map[string]map[*Client]bool),
+		messageCount: make(map[string]int32),
 
-		add:    make(chan *Client, 64),
 		remove: make(chan *Client, 64),
 	}
 }
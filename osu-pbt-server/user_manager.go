@@ -8,7 +8,12 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-const dbFile = "users.db"
+const (
+	dbFile    = "users.db"
+	devDBFile = "users-dev.db" // -dev mode keeps its fake users apart
+)
+
+const mailPurgeInterval = 10 * time.Minute
 
 const schema = `CREATE TABLE Users 
 (uid INTEGER INTEGER NOT NULL,
@@ -28,6 +33,42 @@ const schema = `CREATE TABLE Users
 const createIndexSchema = `CREATE INDEX username_index
  ON Users (username);`
 
+const mailboxSchema = `CREATE TABLE IF NOT EXISTS Mailbox
+(id INTEGER PRIMARY KEY AUTOINCREMENT,
+ uid INTEGER NOT NULL,
+ message TEXT NOT NULL,
+ date INTEGER NOT NULL
+);
+ `
+const createMailboxIndexSchema = `CREATE INDEX IF NOT EXISTS mailbox_uid_index
+ ON Mailbox (uid);`
+
+const devicesSchema = `CREATE TABLE IF NOT EXISTS Devices
+(id INTEGER PRIMARY KEY AUTOINCREMENT,
+ uid INTEGER NOT NULL,
+ name TEXT NOT NULL,
+ secret_hash TEXT NOT NULL,
+ created_date INTEGER NOT NULL,
+ last_used_date INTEGER NOT NULL
+);
+ `
+const createDevicesIndexSchema = `CREATE INDEX IF NOT EXISTS devices_uid_index
+ ON Devices (uid);`
+
+const rolesSchema = `CREATE TABLE IF NOT EXISTS Roles
+(uid INTEGER PRIMARY KEY,
+ role INTEGER NOT NULL
+);
+ `
+
+const preferencesSchema = `CREATE TABLE IF NOT EXISTS Preferences
+(uid INTEGER NOT NULL,
+ name TEXT NOT NULL,
+ value INTEGER NOT NULL,
+ PRIMARY KEY (uid, name)
+);
+ `
+
 type UserManager struct {
 	db *sqlx.DB
 }
@@ -119,6 +160,16 @@ func (um *UserManager) GetUserByUsername(username string) (*User, bool) {
 	return &user, true
 }
 
+// GetBannedUsers returns the users whose ban isn't over, the longest banned first.
+func (um *UserManager) GetBannedUsers() []User {
+	const getSQL = `SELECT * FROM Users WHERE banned = 1 AND banned_date + banned_duration > $0 ORDER BY banned_date + banned_duration DESC`
+	users := []User{}
+	if err := um.db.Select(&users, getSQL, now()); err != nil {
+		log.Errorf("Database Exception. Can't get banned users. (%s)", err)
+	}
+	return users
+}
+
 func (um *UserManager) Update(user *User) {
 	const updateSQL = `UPDATE Users SET
 						   username = $0,
@@ -150,6 +201,227 @@ func (um *UserManager) Update(user *User) {
 	}
 }
 
+// PushMail queues a message for an offline user, keeping only the newest config.MailboxSize messages.
+func (um *UserManager) PushMail(uid int64, message string) {
+	const insertMailSQL = `INSERT INTO Mailbox (uid, message, date) VALUES($0, $1, $2)`
+	const trimMailboxSQL = `DELETE FROM Mailbox
+						WHERE uid = $0 AND id NOT IN
+							(SELECT id FROM Mailbox WHERE uid = $0 ORDER BY id DESC LIMIT $1)`
+
+	if _, err := um.db.Exec(insertMailSQL, uid, message, now()); err != nil {
+		log.Errorf("Database Exception. Can't push mail {uid: %d}. (%s)", uid, err)
+		return
+	}
+
+	if _, err := um.db.Exec(trimMailboxSQL, uid, config.MailboxSize); err != nil {
+		log.Errorf("Database Exception. Can't trim mailbox {uid: %d}. (%s)", uid, err)
+	}
+}
+
+// PopMails takes all unexpired messages of a user out of the mailbox, oldest first.
+func (um *UserManager) PopMails(uid int64) []Mail {
+	const getMailsSQL = `SELECT * FROM Mailbox WHERE uid = $0 ORDER BY id`
+	//only the selected mails, a mail pushed meanwhile waits for the next pop
+	const clearMailboxSQL = `DELETE FROM Mailbox WHERE uid = $0 AND id <= $1`
+
+	tx, err := um.db.Beginx()
+	if err != nil {
+		log.Errorf("Database Exception. Can't get mails {uid: %d}. (%s)", uid, err)
+		return nil
+	}
+	defer tx.Rollback()
+
+	all := []Mail{}
+	if err := tx.Select(&all, getMailsSQL, uid); err != nil {
+		log.Errorf("Database Exception. Can't get mails {uid: %d}. (%s)", uid, err)
+		return nil
+	}
+	if len(all) == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec(clearMailboxSQL, uid, all[len(all)-1].ID); err != nil {
+		log.Errorf("Database Exception. Can't clear mailbox {uid: %d}. (%s)", uid, err)
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		log.Errorf("Database Exception. Can't clear mailbox {uid: %d}. (%s)", uid, err)
+		return nil
+	}
+
+	mails := []Mail{}
+	expired := mailExpiredBefore()
+	for _, mail := range all {
+		if mail.Date >= expired {
+			mails = append(mails, mail)
+		}
+	}
+	return mails
+}
+
+// PurgeMails drops the expired messages of all users, also of those who never come back.
+func (um *UserManager) PurgeMails() {
+	const purgeSQL = `DELETE FROM Mailbox WHERE date < $0`
+
+	result, err := um.db.Exec(purgeSQL, mailExpiredBefore())
+	if err != nil {
+		log.Errorf("Database Exception. Can't purge mailbox. (%s)", err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		log.Infof("[Mailbox] Purged %d expired messages", n)
+	}
+}
+
+func (um *UserManager) purgeMailsLoop() {
+	ticker := time.NewTicker(mailPurgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		um.PurgeMails()
+	}
+}
+
+// mailExpiredBefore is the date mails older than config.MailboxTTL are dated before.
+func mailExpiredBefore() int64 {
+	return now() - toMs(time.Duration(config.MailboxTTL)*time.Minute)
+}
+
+// AddDevice binds a new device to a user, only the hash of the device secret is stored.
+func (um *UserManager) AddDevice(uid int64, name string, secretHash string) (*Device, bool) {
+	const insertDeviceSQL = `INSERT INTO Devices (uid, name, secret_hash, created_date, last_used_date)
+						VALUES($0, $1, $2, $3, $3)`
+
+	date := now()
+	result, err := um.db.Exec(insertDeviceSQL, uid, name, secretHash, date)
+	if err != nil {
+		log.Errorf("Database Exception. Can't add device {uid: %d}. (%s)", uid, err)
+		return nil, false
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Errorf("Database Exception. Can't add device {uid: %d}. (%s)", uid, err)
+		return nil, false
+	}
+
+	return &Device{
+		ID:           id,
+		UID:          uid,
+		Name:         name,
+		SecretHash:   secretHash,
+		CreatedDate:  date,
+		LastUsedDate: date,
+	}, true
+}
+
+func (um *UserManager) GetDeviceBySecret(uid int64, secretHash string) (*Device, bool) {
+	const getSQL = `SELECT * FROM Devices WHERE uid = $0 AND secret_hash = $1`
+	device := Device{}
+	if err := um.db.Get(&device, getSQL, uid, secretHash); err != nil {
+		return nil, false
+	}
+	return &device, true
+}
+
+func (um *UserManager) TouchDevice(device *Device) {
+	const touchSQL = `UPDATE Devices SET last_used_date = $0 WHERE id = $1`
+	device.LastUsedDate = now()
+	if _, err := um.db.Exec(touchSQL, device.LastUsedDate, device.ID); err != nil {
+		log.Errorf("Database Exception. Can't update device {id: %d}. (%s)", device.ID, err)
+	}
+}
+
+func (um *UserManager) GetDevices(uid int64) []Device {
+	const getSQL = `SELECT * FROM Devices WHERE uid = $0 ORDER BY id`
+	devices := []Device{}
+	if err := um.db.Select(&devices, getSQL, uid); err != nil {
+		log.Errorf("Database Exception. Can't get devices {uid: %d}. (%s)", uid, err)
+	}
+	return devices
+}
+
+func (um *UserManager) RenameDevice(uid int64, id int64, name string) bool {
+	const renameSQL = `UPDATE Devices SET name = $0 WHERE uid = $1 AND id = $2`
+	result, err := um.db.Exec(renameSQL, name, uid, id)
+	if err != nil {
+		log.Errorf("Database Exception. Can't rename device {uid: %d, id: %d}. (%s)", uid, id, err)
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n > 0
+}
+
+func (um *UserManager) RemoveDevice(uid int64, id int64) bool {
+	const removeSQL = `DELETE FROM Devices WHERE uid = $0 AND id = $1`
+	result, err := um.db.Exec(removeSQL, uid, id)
+	if err != nil {
+		log.Errorf("Database Exception. Can't remove device {uid: %d, id: %d}. (%s)", uid, id, err)
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n > 0
+}
+
+// GetRole returns the role of a user, ROLE_USER if none is set.
+func (um *UserManager) GetRole(uid int64) int {
+	const getSQL = `SELECT role FROM Roles WHERE uid = $0`
+	role := ROLE_USER
+	um.db.Get(&role, getSQL, uid)
+	return role
+}
+
+func (um *UserManager) SetRole(uid int64, role int) {
+	const deleteSQL = `DELETE FROM Roles WHERE uid = $0`
+	const replaceSQL = `INSERT OR REPLACE INTO Roles VALUES($0, $1)`
+
+	var err error
+	if role == ROLE_USER {
+		_, err = um.db.Exec(deleteSQL, uid)
+	} else {
+		_, err = um.db.Exec(replaceSQL, uid, role)
+	}
+	if err != nil {
+		log.Errorf("Database Exception. Can't set role {uid: %d, role: %d}. (%s)", uid, role, err)
+	}
+}
+
+// GetStaff returns every moderator and admin.
+func (um *UserManager) GetStaff() []Role {
+	const getSQL = `SELECT * FROM Roles ORDER BY role DESC, uid`
+	roles := []Role{}
+	if err := um.db.Select(&roles, getSQL); err != nil {
+		log.Errorf("Database Exception. Can't get roles. (%s)", err)
+	}
+	return roles
+}
+
+// GetPreferences returns the stored preferences of a user over the defaults.
+func (um *UserManager) GetPreferences(uid int64) Preferences {
+	const getSQL = `SELECT name, value FROM Preferences WHERE uid = $0`
+	rows := []struct {
+		Name  string `db:"name"`
+		Value bool   `db:"value"`
+	}{}
+
+	prefs := defaultPreferences()
+	if err := um.db.Select(&rows, getSQL, uid); err != nil {
+		log.Errorf("Database Exception. Can't get preferences {uid: %d}. (%s)", uid, err)
+		return prefs
+	}
+	for _, row := range rows {
+		prefs.Set(row.Name, row.Value)
+	}
+	return prefs
+}
+
+func (um *UserManager) SetPreference(uid int64, name string, on bool) {
+	const replaceSQL = `INSERT OR REPLACE INTO Preferences VALUES($0, $1, $2)`
+	if _, err := um.db.Exec(replaceSQL, uid, name, on); err != nil {
+		log.Errorf("Database Exception. Can't set preference {uid: %d, name: %s}. (%s)", uid, name, err)
+	}
+}
+
 func now() int64 {
 	return time.Now().UnixNano() / int64(time.Millisecond)
 }
@@ -158,7 +430,7 @@ func toMs(d time.Duration) int64 {
 	return d.Nanoseconds() / int64(time.Millisecond)
 }
 
-func NewUserManager() *UserManager {
+func NewUserManager(dbFile string) *UserManager {
 	_, err := os.Stat(dbFile)
 	dbNotExist := os.IsNotExist(err)
 
@@ -175,9 +447,20 @@ func NewUserManager() *UserManager {
 		tx.Commit()
 	}
 
+	//tables added after the first release
+	tx := db.MustBegin()
+	tx.MustExec(mailboxSchema)
+	tx.MustExec(createMailboxIndexSchema)
+	tx.MustExec(devicesSchema)
+	tx.MustExec(createDevicesIndexSchema)
+	tx.MustExec(rolesSchema)
+	tx.MustExec(preferencesSchema)
+	tx.Commit()
+
 	userManager := &UserManager{
 		db: db,
 	}
 
+	go userManager.purgeMailsLoop()
 	return userManager
 }
@@ -1,5 +1,52 @@
 package main
 
-import "github.com/hashicorp/go-version"
+import (
+	"fmt"
+
+	"github.com/hashicorp/go-version"
+)
 
 var VERSION = version.Must(version.NewVersion("1.3.0"))
+
+// PROTOCOL_V2_VERSION is the first plugin version speaking the v2 envelope protocol.
+var PROTOCOL_V2_VERSION = version.Must(version.NewVersion("2.0.0"))
+
+// Plugin version policy, loaded from config.json. nil means no limit.
+var (
+	minPluginVersion        *version.Version
+	deprecatedPluginVersion *version.Version
+)
+
+func loadVersionPolicy() {
+	if len(config.MinVersion) > 0 {
+		ver, err := version.NewVersion(config.MinVersion)
+		if err != nil {
+			panic("Can't parse minVersion")
+		}
+		minPluginVersion = ver
+	}
+
+	if len(config.DeprecatedBelow) > 0 {
+		ver, err := version.NewVersion(config.DeprecatedBelow)
+		if err != nil {
+			panic("Can't parse deprecatedBelow")
+		}
+		deprecatedPluginVersion = ver
+	}
+}
+
+// checkPluginVersion returns the reason a plugin version is rejected, or "" if it is accepted.
+func checkPluginVersion(ver *version.Version) string {
+	if ver == nil {
+		return "The version of the PublicOsuBotTransfer plugin is malformed."
+	}
+	if minPluginVersion != nil && ver.LessThan(minPluginVersion) {
+		return fmt.Sprintf("The PublicOsuBotTransfer plugin %s is no longer supported. Please update it to %s or later.", ver, minPluginVersion)
+	}
+	return ""
+}
+
+// isDeprecatedPluginVersion reports whether the plugin should be asked to upgrade.
+func isDeprecatedPluginVersion(ver *version.Version) bool {
+	return deprecatedPluginVersion != nil && ver.LessThan(deprecatedPluginVersion)
+}
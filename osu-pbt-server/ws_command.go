@@ -1,6 +1,243 @@
 package main
 
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Binary frame layout, all numbers are little-endian:
+//
+//	without CAP_REQUEST_ID: uint16 opcode | payload
+//	with CAP_REQUEST_ID:    uint16 opcode | uint32 request id | payload
+//
+// A reply carries the id of its request, frames pushed by the server carry 0.
+// Strings in a payload are encoded as int32 length | utf-8 bytes, bools as uint8,
+// slices as int32 count | elements.
 const (
-	REQ_TOKEN uint16 = 1
-	RPL_TOKEN uint16 = 2
+	REQ_TOKEN   uint16 = 1
+	RPL_TOKEN   uint16 = 2
+	RPL_ERROR   uint16 = 3
+	REQ_STATUS  uint16 = 4
+	RPL_STATUS  uint16 = 5
+	REQ_QUOTA   uint16 = 6
+	RPL_QUOTA   uint16 = 7
+	REQ_PP      uint16 = 8
+	RPL_PP      uint16 = 9
+	REQ_VERSION uint16 = 10
+	RPL_VERSION uint16 = 11
+
+	REQ_ACK_CAPABILITIES uint16 = 12
+	RPL_CAPABILITIES     uint16 = 13
+
+	RPL_PRESENCE    uint16 = 14 // pushed, the user joined or left #osu
+	RPL_NOW_PLAYING uint16 = 15 // pushed, the user sent /np
+	REQ_PREFERENCES uint16 = 16
+	RPL_PREFERENCES uint16 = 17
 )
+
+var opcodeNames = map[uint16]string{
+	RPL_TOKEN:   "token",
+	RPL_ERROR:   "error",
+	RPL_STATUS:  "status",
+	RPL_QUOTA:   "quota",
+	RPL_PP:      "pp",
+	RPL_VERSION: "version",
+
+	RPL_CAPABILITIES: "capabilities",
+
+	RPL_PRESENCE:    "presence",
+	RPL_NOW_PLAYING: "now-playing",
+	RPL_PREFERENCES: "preferences",
+}
+
+// WSRequest is a request of a Sync client, from a binary frame or a v2 command envelope.
+type WSRequest struct {
+	Opcode  uint16
+	ID      uint64
+	Payload []byte
+}
+
+type TokenReply struct {
+	Token string `json:"token"`
+}
+
+type ErrorReply struct {
+	Opcode  uint16 `json:"opcode"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type StatusReply struct {
+	ConnectionID  int64 `json:"connectionId"`
+	Connections   int32 `json:"connections"`
+	Paired        bool  `json:"paired"`
+	IRCOnline     bool  `json:"ircOnline"`
+	TokenAssigned bool  `json:"tokenAssigned"`
+	Bridged       bool  `json:"bridged"` // the server is connected to Bancho
+}
+
+type QuotaReply struct {
+	Limit     int32 `json:"limit"`
+	Used      int32 `json:"used"`
+	Remaining int32 `json:"remaining"`
+	ResetIn   int32 `json:"resetIn"` // seconds
+}
+
+type PPReply struct {
+	Std   float64 `json:"std"`
+	Taiko float64 `json:"taiko"`
+	Ctb   float64 `json:"ctb"`
+	Mania float64 `json:"mania"`
+}
+
+type VersionReply struct {
+	Server   string `json:"server"`
+	Protocol int32  `json:"protocol"`
+}
+
+type wsHandler struct {
+	name    string
+	handler func(*Client, *WSRequest)
+}
+
+// WSCommandManager dispatches the requests of Sync clients by opcode.
+type WSCommandManager struct {
+	handlers map[uint16]wsHandler
+	names    map[string]uint16
+}
+
+// AddHandler registers a request opcode, name is used by v2 command envelopes.
+func (wm *WSCommandManager) AddHandler(opcode uint16, name string, handler func(*Client, *WSRequest)) {
+	wm.handlers[opcode] = wsHandler{
+		name:    name,
+		handler: handler,
+	}
+	wm.names[name] = opcode
+}
+
+// Opcode looks up the opcode of a v2 command.
+func (wm *WSCommandManager) Opcode(name string) (uint16, bool) {
+	opcode, ok := wm.names[name]
+	return opcode, ok
+}
+
+// Opcodes returns all request opcodes in ascending order.
+func (wm *WSCommandManager) Opcodes() []uint16 {
+	opcodes := make([]uint16, 0, len(wm.handlers))
+	for opcode := range wm.handlers {
+		opcodes = append(opcodes, opcode)
+	}
+	sort.Slice(opcodes, func(i, j int) bool { return opcodes[i] < opcodes[j] })
+	return opcodes
+}
+
+func (wm *WSCommandManager) Dispatch(c *Client, req *WSRequest) {
+	h, ok := wm.handlers[req.Opcode]
+	if !ok {
+		c.ReplyError(req, ERROR_UNKNOWN_COMMAND, fmt.Sprintf("Unknown opcode: %d", req.Opcode))
+		return
+	}
+	h.handler(c, req)
+}
+
+func NewWSCommandManager() *WSCommandManager {
+	return &WSCommandManager{
+		handlers: make(map[uint16]wsHandler),
+		names:    make(map[string]uint16),
+	}
+}
+
+// correlated reports whether the client puts request ids into binary frames.
+func (c *Client) correlated() bool {
+	return c.Can(CAP_REQUEST_ID)
+}
+
+// parseWSRequest decodes a binary frame of the client.
+func (c *Client) parseWSRequest(message []byte) (*WSRequest, bool) {
+	if len(message) < 2 {
+		return nil, false
+	}
+
+	req := &WSRequest{Opcode: binary.LittleEndian.Uint16(message)}
+	if !c.correlated() {
+		req.Payload = message[2:]
+		return req, true
+	}
+
+	if len(message) < 6 {
+		return nil, false
+	}
+	req.ID = uint64(binary.LittleEndian.Uint32(message[2:]))
+	req.Payload = message[6:]
+	return req, true
+}
+
+// Reply answers a request with a reply opcode and its payload.
+func (c *Client) Reply(req *WSRequest, opcode uint16, data interface{}) {
+	if c.protocol == PROTOCOL_V2 {
+		c.sendEnvelope(ENVELOPE_REPLY, req.ID, ReplyData{
+			Name:   opcodeNames[opcode],
+			Result: data,
+		})
+		return
+	}
+
+	c.SendBinaryToWS(c.encodeFrame(opcode, req.ID, data))
+}
+
+// ReplyError tells the client why a request failed.
+func (c *Client) ReplyError(req *WSRequest, code string, message string) {
+	if c.protocol == PROTOCOL_V2 {
+		c.sendErrorEnvelope(req.ID, code, message)
+		return
+	}
+
+	c.SendBinaryToWS(c.encodeFrame(RPL_ERROR, req.ID, ErrorReply{
+		Opcode:  req.Opcode,
+		Code:    code,
+		Message: message,
+	}))
+}
+
+func (c *Client) encodeFrame(opcode uint16, id uint64, data interface{}) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, opcode)
+	if c.correlated() {
+		binary.Write(buf, binary.LittleEndian, uint32(id))
+	}
+	writeBinaryPayload(buf, data)
+	return buf.Bytes()
+}
+
+// writeBinaryPayload writes the fields of a reply struct in declaration order.
+func writeBinaryPayload(buf *bytes.Buffer, data interface{}) {
+	v := reflect.ValueOf(data)
+	for i := 0; i < v.NumField(); i++ {
+		writeBinaryValue(buf, v.Field(i))
+	}
+}
+
+func writeBinaryValue(buf *bytes.Buffer, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		str := []byte(v.String())
+		binary.Write(buf, binary.LittleEndian, int32(len(str)))
+		buf.Write(str)
+	case reflect.Bool:
+		var b uint8
+		if v.Bool() {
+			b = 1
+		}
+		buf.WriteByte(b)
+	case reflect.Slice:
+		binary.Write(buf, binary.LittleEndian, int32(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			writeBinaryValue(buf, v.Index(i))
+		}
+	default:
+		binary.Write(buf, binary.LittleEndian, v.Interface())
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// WebSocket protocol revisions, negotiated by the version cookie.
+const (
+	PROTOCOL_LEGACY = 1
+	PROTOCOL_V2     = 2
+)
+
+// Envelope types of the v2 protocol.
+const (
+	ENVELOPE_CHAT      = "chat"
+	ENVELOPE_NOTICE    = "notice"
+	ENVELOPE_COMMAND   = "command"
+	ENVELOPE_REPLY     = "reply"
+	ENVELOPE_ERROR     = "error"
+	ENVELOPE_PP_UPDATE = "pp-update"
+	ENVELOPE_SESSION   = "session"
+	ENVELOPE_PAIRING   = "pairing"
+	ENVELOPE_DEVICE    = "device"
+	ENVELOPE_PRESENCE  = "presence"
+
+	ENVELOPE_NOW_PLAYING = "now-playing"
+
+	ENVELOPE_CAPABILITIES = "capabilities"
+)
+
+// COMMAND_PING is answered by the envelope layer, other commands are dispatched by wsCommandManager.
+const COMMAND_PING = "ping"
+
+// Error codes carried by v2 error envelopes.
+const (
+	ERROR_BAD_ENVELOPE    = "bad_envelope"
+	ERROR_UNKNOWN_TYPE    = "unknown_type"
+	ERROR_UNKNOWN_COMMAND = "unknown_command"
+	ERROR_RATE_LIMITED    = "rate_limited"
+	ERROR_BUSY            = "busy"
+	ERROR_NOT_PAIRED      = "not_paired"
+	ERROR_QUEUE_FULL      = "queue_full"
+)
+
+// Envelope is a v2 WebSocket frame.
+// Every text frame of the v2 protocol is an Envelope encoded as JSON.
+type Envelope struct {
+	ID      uint64          `json:"id"`
+	Type    string          `json:"type"`
+	ReplyTo uint64          `json:"replyTo,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type TextData struct {
+	Text string `json:"text"`
+}
+
+type CommandData struct {
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type ReplyData struct {
+	Name   string      `json:"name"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+type ErrorData struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type SessionData struct {
+	ResumeID string `json:"resumeId"`
+	Resumed  bool   `json:"resumed"`
+	Replayed int    `json:"replayed,omitempty"`
+	Lost     int    `json:"lost,omitempty"`
+}
+
+type PairingData struct {
+	Code string `json:"code"`
+}
+
+type DeviceData struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Secret string `json:"secret,omitempty"`
+}
+
+type PPUpdateData struct {
+	BeatmapID int64   `json:"beatmapId"`
+	Mode      int     `json:"mode"`
+	PP        float64 `json:"pp"`
+	Delta     float64 `json:"delta"`
+}
+
+type PresenceData struct {
+	Nick   string `json:"nick"`
+	Online bool   `json:"online"`
+	Since  int64  `json:"since"` // unix time
+}
+
+type NowPlayingData struct {
+	Action    string   `json:"action"` // listening to, playing, watching or editing
+	BeatmapID int64    `json:"beatmapId"`
+	Mods      []string `json:"mods"`
+	Mode      int32    `json:"mode"`
+	Title     string   `json:"title"`
+	Artist    string   `json:"artist"`
+	Version   string   `json:"version"` // difficulty name
+	Stars     float64  `json:"stars"`
+	Text      string   `json:"text"` // rendered line for viewers
+}
+
+func (c *Client) sendEnvelope(envelopeType string, replyTo uint64, data interface{}) {
+	if c.session == nil {
+		log.Warningf("[WS] %s: Can't send a %s envelope on the binary protocol.", c.user.Username, envelopeType)
+		return
+	}
+	if frame, ok := c.session.record(envelopeType, replyTo, data, ""); ok {
+		c.enqueue(frame)
+	}
+}
+
+func (c *Client) sendErrorEnvelope(replyTo uint64, code string, message string) {
+	c.sendEnvelope(ENVELOPE_ERROR, replyTo, ErrorData{
+		Code:    code,
+		Message: message,
+	})
+}
+
+func (c *Client) processEnvelope(message []byte) {
+	var envelope Envelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		c.sendErrorEnvelope(0, ERROR_BAD_ENVELOPE, "The frame is not a valid envelope.")
+		return
+	}
+
+	switch envelope.Type {
+	case ENVELOPE_CHAT:
+		var chat TextData
+		if err := json.Unmarshal(envelope.Data, &chat); err != nil {
+			c.sendErrorEnvelope(envelope.ID, ERROR_BAD_ENVELOPE, "The chat envelope has no text.")
+			return
+		}
+		c.processChatMessage(envelope.ID, []byte(chat.Text))
+
+	case ENVELOPE_COMMAND:
+		var cmd CommandData
+		if err := json.Unmarshal(envelope.Data, &cmd); err != nil {
+			c.sendErrorEnvelope(envelope.ID, ERROR_BAD_ENVELOPE, "The command envelope has no name.")
+			return
+		}
+
+		if cmd.Name == COMMAND_PING {
+			c.conn.SetReadDeadline(time.Now().Add(pongWait))
+			c.sendEnvelope(ENVELOPE_REPLY, envelope.ID, ReplyData{Name: "pong"})
+			return
+		}
+
+		opcode, ok := wsCommandManager.Opcode(cmd.Name)
+		if !ok {
+			c.sendErrorEnvelope(envelope.ID, ERROR_UNKNOWN_COMMAND, "Unknown command: "+cmd.Name)
+			return
+		}
+		wsCommandManager.Dispatch(c, &WSRequest{
+			Opcode:  opcode,
+			ID:      envelope.ID,
+			Payload: cmd.Args,
+		})
+
+	default:
+		c.sendErrorEnvelope(envelope.ID, ERROR_UNKNOWN_TYPE, "Unknown envelope type: "+envelope.Type)
+	}
+}